@@ -2,12 +2,17 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -15,6 +20,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
@@ -43,21 +49,36 @@ var defaultArgs = []string{
 	"--exclude", "214.0.0.0/7",
 }
 var status = ""
-var server = "***REMOVED***"
-var password = "***REMOVED***"
+var server = os.Getenv("VNCJEW_SERVER")
+var name = envOr("VNCJEW_CLIENT_NAME", "client")
+var certFile = envOr("VNCJEW_CERT", name + ".crt")
+var keyFile = envOr("VNCJEW_KEY", name + ".key")
+var caFile = envOr("VNCJEW_CA", "ca.crt")
 var started = false
-var rate = ""
+// maxRate is this worker's own ceiling, the server's is used if it is lower
+var maxRate = 0
+var actualRate = ""
+var excludes []string
+var rescan = false
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "csr" {
+		if err := makeCSR(); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	user, err := user.Current()
 	if err != nil || user.Uid != "0" {
 		log.Fatalln("Run as root!")
 	}
 
 	if len(os.Args) > 1 {
-		rate = os.Args[1]
-	} else {
-		rate = "100000"
+		maxRate, err = strconv.Atoi(os.Args[1])
+		if err != nil || maxRate <= 0 {
+			log.Fatalln("Invalid rate", os.Args[1])
+		}
 	}
 
 	iptables := exec.Command("iptables", "-A", "INPUT", "-p", "tcp", "--dport", sourcePort, "-j", "DROP")
@@ -66,18 +87,19 @@ func main() {
 		log.Println("Please install iptables to work propery")
 	}
 
-	sec := "s"
-	if len(os.Args) > 2 && os.Args[2] == "http" {
-		sec = ""
+	if server == "" {
+		log.Fatalln("Set VNCJEW_SERVER to the server's host:port")
+	}
+	tlsConfig, err := loadTLS()
+	if err != nil {
+		log.Fatalln(err)
 	}
-
-	auth := base64.StdEncoding.EncodeToString([]byte("client:" + password))
 
 	ws, err = websocket.DialConfig(&websocket.Config{
-		Location: &url.URL{Scheme: "ws" + sec, Host: server, Path: "/api/client"},
+		Location: &url.URL{Scheme: "wss", Host: server, Path: "/api/client"},
 		Origin: &url.URL{Scheme: "https", Host: server},
 		Version: websocket.ProtocolVersionHybi13,
-		Header: http.Header{"Authorization": {"Basic " + auth}},
+		TlsConfig: tlsConfig,
 	})
 	if err != nil {
 		log.Fatalln(err)
@@ -96,13 +118,103 @@ func main() {
 		case "status": writeMSG("status", getStatus())
 		case "start": writeMSG("start", start())
 		case "stop": writeMSG("stop", stop())
-		case "range": go scanRange(msg[1])
+		case "range": go scanRange(msg[1:])
+		case "exclude": setExcludes(msg[1:])
 		case "vnc": log.Println(msg[1])
-		case "ping": writeMSG("pong")
+		case "ping":
+			writeMSG("pong")
+			if running() && actualRate != "" {
+				writeMSG("rate", actualRate)
+			}
 		}
 	}
 }
 
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// readSecretFile refuses secrets that anyone but the owner can read.
+func readSecretFile(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm() & 0077 != 0 {
+		return "", fmt.Errorf("%s is accessible by group or others, chmod 600 it", file)
+	}
+	data, err := os.ReadFile(file)
+	return strings.TrimSpace(string(data)), err
+}
+
+// makeCSR creates this worker's key and a request for the server to sign,
+// the key never has to leave the worker.
+func makeCSR() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(keyFile, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	f.Close()
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: name},
+	}, key)
+	if err != nil {
+		return err
+	}
+	csrFile := name + ".csr"
+	err = os.WriteFile(csrFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, have it enrolled and put the certificate in %s\n", csrFile, certFile)
+	return nil
+}
+
+// loadTLS sets up this worker's certificate, and only trusts servers signed
+// by the CA it was enrolled with.
+func loadTLS() (*tls.Config, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readSecretFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, []byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs: pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
 func start() string {
 	if started || running() {
 		return "Already started"
@@ -131,11 +243,45 @@ func getStatus() string {
 	return "Idling"
 }
 
-func scanRange(rnge string) {
+// scanRange runs masscan on ["range", cidr, rate, until] from the server, at
+// no more than the rate it allows and only until its maintenance window
+// ends. When done it asks for the next range with ["range", "done"], or
+// ["range", "cut"] if the window ended first.
+func scanRange(msg []string) {
+	rnge := msg[0]
 	if rnge == "stop" {
 		stop()
 		return
 	}
+	if rnge == "wait" {
+		secs, _ := strconv.Atoi(msg[1])
+		log.Printf("Server says wait %d seconds", secs)
+		time.Sleep(time.Duration(secs) * time.Second)
+		if started && !running() {
+			writeMSG("range")
+		}
+		return
+	}
+	if len(msg) < 3 {
+		log.Printf("Got range %s without limits", rnge)
+		return
+	}
+	rate, err := strconv.Atoi(msg[1])
+	if err != nil || rate <= 0 {
+		log.Printf("Got range %s with invalid rate %s", rnge, msg[1])
+		return
+	}
+	if maxRate > 0 && maxRate < rate {
+		rate = maxRate
+	}
+	var until time.Time
+	if msg[2] != "" {
+		until, err = time.Parse(time.RFC3339, msg[2])
+		if err != nil {
+			log.Printf("Got range %s with invalid window end %s", rnge, msg[2])
+			return
+		}
+	}
 	if running() {
 		log.Printf("Got range %s even though masscan still running", rnge)
 		return
@@ -145,7 +291,11 @@ func scanRange(rnge string) {
 		return
 	}
 	status = "Starting..."
-	args := append(defaultArgs, "--rate", rate, rnge)
+	args := append([]string{}, defaultArgs...)
+	for _, e := range excludes {
+		args = append(args, "--exclude", e)
+	}
+	args = append(args, "--rate", strconv.Itoa(rate), rnge)
 	log.Println("Running masscan with args", args)
 	masscan = exec.Command("masscan", args...)
 	stdout, err := masscan.StdoutPipe()
@@ -160,12 +310,43 @@ func scanRange(rnge string) {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if !until.IsZero() {
+		cmd := masscan
+		timer := time.AfterFunc(time.Until(until), func() {
+			log.Println("Maintenance window over, stopping", rnge)
+			cmd.Process.Kill()
+		})
+		defer timer.Stop()
+	}
 
 	go readStatus(stderr)
 	readVNCs(stdout)
 	masscan.Wait()
+	actualRate = ""
+	if rescan {
+		rescan = false
+		scanRange(msg)
+		return
+	}
 	if started {
-		writeMSG("range")
+		// tell the server so it hands the rest of the range out again
+		if !until.IsZero() && !time.Now().Before(until) {
+			writeMSG("range", "cut")
+		} else {
+			writeMSG("range", "done")
+		}
+	}
+}
+
+// setExcludes takes the opt out list from the server, a running scan is
+// restarted so it takes effect straight away.
+func setExcludes(list []string) {
+	excludes = list
+	log.Println("Excluding", len(excludes), "opted out networks")
+	if running() {
+		log.Println("Opt outs changed, restarting scan")
+		rescan = true
+		masscan.Process.Kill()
 	}
 }
 
@@ -176,8 +357,14 @@ func readStatus(from io.ReadCloser) {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	rateRe := regexp.MustCompile(`rate: *([0-9.]+)-kpps`)
 	for scanner.Scan() {
 		status = scanner.Text()
+		if m := rateRe.FindStringSubmatch(status); m != nil {
+			if kpps, err := strconv.ParseFloat(m[1], 64); err == nil {
+				actualRate = strconv.FormatFloat(kpps * 1000, 'f', 0, 64)
+			}
+		}
 		if r.MatchString(status) {
 			if running() {
 				masscan.Process.Kill()
@@ -230,14 +417,11 @@ func running() bool {
 	return masscan != nil && masscan.ProcessState == nil
 }
 
+// readMSG reads a whole message however long it is, the exclude list can
+// get large.
 func readMSG() []string {
-	buf := make([]byte, 1024)
-	n, err := ws.Read(buf)
-	if err != nil {
-		log.Fatalln(err)
-	}
 	var res []string
-	err = json.Unmarshal(buf[:n], &res)
+	err := websocket.JSON.Receive(ws, &res)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AuditEntry is one record of the append only audit log. Every entry holds
+// the hash of the one before it, so editing or removing any entry breaks
+// the chain from that point on.
+type AuditEntry struct {
+	ID uint `gorm:"primaryKey"`
+	Time time.Time
+	Engagement string `gorm:"index"`
+	Actor string
+	Action string
+	Target string
+	Result string
+	PrevHash string
+	Hash string
+}
+
+func (e *AuditEntry) computeHash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%s\n%s\n%s\n%s\n%s\n%s", e.PrevHash, e.ID,
+		e.Time.UTC().Format(time.RFC3339Nano), e.Engagement, e.Actor,
+		e.Action, e.Target, e.Result)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Audit appends e to the audit log and returns it as stored. Failures are
+// logged as well, so callers that can carry on anyway may ignore them.
+// Commands run as their own process, so the last entry is read and the new
+// one written in a single immediate transaction that holds sqlite's write
+// lock, auditMu only orders writers within this process.
+func (db *DB) Audit(e AuditEntry) (AuditEntry, error) {
+	db.auditMu.Lock()
+	defer db.auditMu.Unlock()
+
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		var last AuditEntry
+		if err := tx.Order("id DESC").Limit(1).Find(&last).Error; err != nil {
+			return err
+		}
+		e.ID = last.ID + 1
+		e.Time = time.Now().UTC()
+		e.PrevHash = last.Hash
+		e.Hash = e.computeHash()
+		return tx.Create(&e).Error
+	})
+	if err != nil {
+		log.Printf("Audit %s %s: %s", e.Action, e.Target, err.Error())
+	}
+	return e, err
+}
+
+func (db *DB) GetAudit(engagement string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	q := db.db.Order("id")
+	if engagement != "" {
+		q = q.Where("engagement = ?", engagement)
+	}
+	err := q.Find(&entries).Error
+	return entries, err
+}
+
+// VerifyAudit walks the whole chain and returns the first broken link.
+func (db *DB) VerifyAudit() error {
+	entries, err := db.GetAudit("")
+	if err != nil {
+		return err
+	}
+	prev := ""
+	for i, e := range entries {
+		if e.ID != uint(i + 1) {
+			return fmt.Errorf("audit entry %d missing", i + 1)
+		}
+		if e.PrevHash != prev || e.computeHash() != e.Hash {
+			return fmt.Errorf("audit entry %d has been tampered with", e.ID)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// auditTriggers make sqlite itself refuse to change the audit log.
+var auditTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS audit_no_update BEFORE UPDATE ON audit_entries
+	BEGIN SELECT RAISE(ABORT, 'audit log is append only'); END`,
+	`CREATE TRIGGER IF NOT EXISTS audit_no_delete BEFORE DELETE ON audit_entries
+	BEGIN SELECT RAISE(ABORT, 'audit log is append only'); END`,
+}
+
+func auditResult(err error) string {
+	if err != nil {
+		return strings.TrimSpace(err.Error())
+	}
+	return "ok"
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVerifyAudit(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 3; i++ {
+		if _, err := db.Audit(AuditEntry{Actor: "test", Action: "act", Target: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.VerifyAudit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the triggers keep gorm out, so tamper behind them
+	if err := db.db.Exec("DROP TRIGGER audit_no_update").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.Exec("UPDATE audit_entries SET result = 'forged' WHERE id = 2").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.VerifyAudit(); err == nil {
+		t.Error("VerifyAudit accepted a modified entry")
+	}
+}
+
+func TestAuditAppendOnly(t *testing.T) {
+	db := newTestDB(t)
+	db.Audit(AuditEntry{Actor: "test", Action: "act"})
+	if err := db.db.Exec("UPDATE audit_entries SET result = 'forged'").Error; err == nil {
+		t.Error("update of the audit log succeeded")
+	}
+	if err := db.db.Exec("DELETE FROM audit_entries").Error; err == nil {
+		t.Error("delete from the audit log succeeded")
+	}
+}
+
+// TestAuditProcesses has a second connection, as a command run alongside
+// the server would, append while the first one is auditing.
+func TestAuditProcesses(t *testing.T) {
+	db := newTestDB(t)
+	other, err := NewDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.Audit(AuditEntry{Actor: "server", Action: "act"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := other.db.Begin()
+	done := make(chan error)
+	go func() {
+		_, err := db.Audit(AuditEntry{Actor: "server", Action: "act"})
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	e := AuditEntry{ID: first.ID + 1, Time: time.Now().UTC(), Actor: "cli", Action: "act", PrevHash: first.Hash}
+	e.Hash = e.computeHash()
+	if err := tx.Create(&e).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.GetAudit("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d entries, want 3", len(entries))
+	}
+	if err := db.VerifyAudit(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is a person allowed to browse the results of one engagement.
+type User struct {
+	Name string `gorm:"primaryKey"`
+	PasswordHash string
+	Engagement string
+	Admin bool `gorm:"-"`
+}
+
+func (u *User) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// authUser requires a login from either an admin account, which can see
+// every engagement, or a user from the database.
+func authUser(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name, password, ok := c.Request.BasicAuth()
+		if !ok {
+			unauthorized(c)
+			return
+		}
+
+		if checkAccount(CFGAdminAccount, name, password) {
+			c.Set("account", &User{Name: name, Admin: true})
+			return
+		}
+
+		user, err := db.GetUser(name)
+		if err != nil || !user.CheckPassword(password) {
+			unauthorized(c)
+			return
+		}
+		c.Set("account", &user)
+	}
+}
+
+func checkAccount(accounts map[string]string, name, password string) bool {
+	hash, ok := accounts[name]
+	return ok && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// authAccounts is gin.BasicAuth for hashed accounts, any of the given sets
+// will do.
+func authAccounts(accounts ...map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name, password, ok := c.Request.BasicAuth()
+		if ok {
+			for _, a := range accounts {
+				if checkAccount(a, name, password) {
+					c.Set(gin.AuthUserKey, name)
+					return
+				}
+			}
+		}
+		unauthorized(c)
+	}
+}
+
+func unauthorized(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+func getUser(c *gin.Context) *User {
+	return c.MustGet("account").(*User)
+}
+
+// engagement returns the engagement the request is limited to, or "" when
+// the user may see all of them.
+func engagement(c *gin.Context) string {
+	user := getUser(c)
+	if user.Admin {
+		return ""
+	}
+	return user.Engagement
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Bundle is everything we kept about an engagement, handed to the client
+// encrypted when it is closed out. Users are only named, and credentials
+// are destroyed rather than handed back.
+type Bundle struct {
+	Engagement string
+	Created time.Time
+	Hosts []Host
+	Findings []Finding
+	Audit []AuditEntry
+	AuditVerified string
+	Users []string
+	Workers []Worker
+}
+
+// Receipt is the record of what a close out destroyed. Error is set when it
+// did not get through all of it.
+type Receipt struct {
+	Engagement string
+	Completed time.Time
+	BundleFile string
+	BundleHash string
+	Services []string
+	Hosts int
+	Screenshots int
+	Findings int
+	Credentials []string
+	Users []string
+	Workers []string
+	AuditID uint
+	AuditHash string
+	Error string
+}
+
+// shred overwrites a file with random data before removing it, it reports
+// whether there was anything to shred.
+func shred(file string) (bool, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = io.CopyN(f, rand.Reader, info.Size())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+	return true, os.Remove(file)
+}
+
+// CloseOut exports an engagement into an encrypted bundle, then destroys
+// its hosts, services, findings, screenshots, credentials, users and
+// workers. The bundle key is returned and never stored. Nothing is deleted
+// unless the bundle decrypts, once it is written the key and receipt are
+// returned even if destroying the rest fails.
+func CloseOut(db *DB, scope *Scope, creds *CredStore, engagement, file, actor string) (*Receipt, []byte, error) {
+	if engagement == "" || !scope.HasEngagement(engagement) {
+		return nil, nil, fmt.Errorf("unknown engagement %q", engagement)
+	}
+	bundle := Bundle{Engagement: engagement, Created: time.Now().UTC()}
+	if err := db.ExportEngagement(&bundle); err != nil {
+		return nil, nil, err
+	}
+	bundle.AuditVerified = auditResult(db.VerifyAudit())
+
+	plain, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	data, err := encrypt(key, plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return nil, nil, err
+	}
+	if _, err := OpenBundle(file, key); err != nil {
+		return nil, nil, fmt.Errorf("bundle does not check out, nothing deleted: %w", err)
+	}
+	sum := sha256.Sum256(data)
+
+	receipt := &Receipt{
+		Engagement: engagement,
+		BundleFile: file,
+		BundleHash: hex.EncodeToString(sum[:]),
+		Hosts: len(bundle.Hosts),
+		Findings: len(bundle.Findings),
+		Users: bundle.Users,
+	}
+	for _, w := range bundle.Workers {
+		receipt.Workers = append(receipt.Workers, w.Name)
+	}
+	err = receipt.destroy(db, scope, creds, &bundle)
+
+	entry, aerr := db.Audit(AuditEntry{
+		Engagement: engagement,
+		Actor: actor,
+		Action: "close out",
+		Target: receipt.BundleHash,
+		Result: fmt.Sprintf("%d hosts, %d services, %d screenshots, %d findings, %d credentials, %d users, %d workers: %s",
+			receipt.Hosts, len(receipt.Services), receipt.Screenshots, receipt.Findings,
+			len(receipt.Credentials), len(receipt.Users), len(receipt.Workers), auditResult(err)),
+	})
+	receipt.AuditID, receipt.AuditHash = entry.ID, entry.Hash
+	receipt.Completed = entry.Time
+	if err == nil && aerr != nil {
+		err = fmt.Errorf("close out not audited: %w", aerr)
+	}
+	if err != nil {
+		receipt.Error = err.Error()
+		if receipt.Completed.IsZero() {
+			receipt.Completed = time.Now().UTC()
+		}
+	}
+	return receipt, key, err
+}
+
+// destroy deletes what was exported into bundle, recording it on the
+// receipt as it goes. It carries on past failures so as little as possible
+// is left behind, and returns the first.
+func (r *Receipt) destroy(db *DB, scope *Scope, creds *CredStore, bundle *Bundle) error {
+	err := db.DeleteEngagement(r.Engagement)
+	if err != nil {
+		// the rows are still there, so are the accounts
+		r.Hosts, r.Findings, r.Users, r.Workers = 0, 0, nil, nil
+	}
+	for _, e := range scope.Entries {
+		if e.Engagement != r.Engagement {
+			continue
+		}
+		if _, ok := creds.Get(&e); !ok {
+			continue
+		}
+		if cerr := creds.Delete(&e); cerr != nil {
+			if err == nil {
+				err = cerr
+			}
+			continue
+		}
+		r.Credentials = append(r.Credentials, e.Net.String())
+	}
+	for _, h := range bundle.Hosts {
+		for _, s := range h.Services {
+			port := strconv.Itoa(int(s.Port))
+			r.Services = append(r.Services, net.JoinHostPort(h.Ip, port))
+			for _, f := range []string{screenshotFile(h.Ip, port), rawScreenshotFile(h.Ip, port)} {
+				shredded, serr := shred(f)
+				if shredded {
+					r.Screenshots++
+				}
+				if serr != nil && err == nil {
+					err = serr
+				}
+			}
+		}
+	}
+	if err == nil {
+		var n int64
+		n, err = db.CountHosts(r.Engagement)
+		if err == nil && n != 0 {
+			err = fmt.Errorf("%d hosts left after deleting", n)
+		}
+	}
+	return err
+}
+
+func OpenBundle(file string, key []byte) (*Bundle, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decrypt(key, data)
+	if err != nil {
+		return nil, err
+	}
+	var bundle Bundle
+	return &bundle, json.Unmarshal(plain, &bundle)
+}
+
+func (r *Receipt) Print(w io.Writer) {
+	fmt.Fprintln(w, "DELETION RECEIPT")
+	fmt.Fprintln(w, "Engagement:", r.Engagement)
+	fmt.Fprintln(w, "Completed:", r.Completed.Format(time.RFC3339))
+	fmt.Fprintln(w, "Bundle:", r.BundleFile)
+	fmt.Fprintln(w, "Bundle SHA-256:", r.BundleHash)
+	fmt.Fprintln(w, "Hosts deleted:", r.Hosts)
+	fmt.Fprintln(w, "Services deleted:", len(r.Services))
+	fmt.Fprintln(w, "Screenshots overwritten and deleted:", r.Screenshots)
+	fmt.Fprintln(w, "Findings deleted:", r.Findings)
+	fmt.Fprintln(w, "Credentials deleted:", len(r.Credentials))
+	fmt.Fprintln(w, "Users deleted:", len(r.Users))
+	fmt.Fprintln(w, "Workers deleted:", len(r.Workers))
+	fmt.Fprintf(w, "Audit entry: %d %s\n", r.AuditID, r.AuditHash)
+	if r.Error != "" {
+		fmt.Fprintln(w, "INCOMPLETE:", r.Error)
+	}
+	for _, l := range []struct{ name string; items []string }{
+		{"Services", r.Services},
+		{"Credentials", r.Credentials},
+		{"Users", r.Users},
+		{"Workers", r.Workers},
+	} {
+		if len(l.items) > 0 {
+			fmt.Fprintln(w, l.name + ":")
+		}
+		for _, s := range l.items {
+			fmt.Fprintln(w, "  ", s)
+		}
+	}
+}
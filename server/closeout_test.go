@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestCloseOut(t *testing.T) (*DB, *Scope, *CredStore) {
+	chdirTemp(t)
+	os.Mkdir("screenshots", 0700)
+	db := newTestDB(t)
+	scope, err := LoadScope(writeScope(t, "10.0.0.0/24 a\n10.1.0.0/24 b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := LoadCredStore("creds.enc", "creds.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestHost(t, db, "10.0.0.1", "a", 5900)
+	addTestHost(t, db, "10.1.0.1", "b", 5901, 5902)
+	db.Audit(AuditEntry{Engagement: "a", Action: "scan"})
+	db.Audit(AuditEntry{Engagement: "b", Action: "scan"})
+	for _, e := range []string{"a", "b"} {
+		db.SaveUser(&User{Name: "user-" + e, Engagement: e})
+		db.SaveWorker(&Worker{Name: "worker-" + e, Engagement: e, Fingerprint: e})
+	}
+	for i := range scope.Entries {
+		creds.Set(&scope.Entries[i], Credential{"user", "password"})
+	}
+	return db, scope, creds
+}
+
+func TestCloseOut(t *testing.T) {
+	db, scope, creds := newTestCloseOut(t)
+	os.WriteFile(screenshotFile("10.0.0.1", "5900"), []byte("jpeg"), 0600)
+	os.WriteFile(screenshotFile("10.1.0.1", "5901"), []byte("jpeg"), 0600)
+
+	file := filepath.Join(t.TempDir(), "bundle")
+	for _, e := range []string{"", "c"} {
+		if _, _, err := CloseOut(db, scope, creds, e, file, "test"); err == nil {
+			t.Errorf("closed out engagement %q", e)
+		}
+	}
+	if n, _ := db.CountHosts(""); n != 2 {
+		t.Fatalf("%d hosts left after rejected close outs", n)
+	}
+
+	receipt, key, err := CloseOut(db, scope, creds, "a", file, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Hosts != 1 || len(receipt.Services) != 1 || receipt.Screenshots != 1 ||
+		receipt.AuditID == 0 || receipt.AuditHash == "" || receipt.Error != "" {
+		t.Errorf("unexpected receipt %+v", receipt)
+	}
+	for _, l := range []struct{ got, want []string }{
+		{receipt.Credentials, []string{"10.0.0.0/24"}},
+		{receipt.Users, []string{"user-a"}},
+		{receipt.Workers, []string{"worker-a"}},
+	} {
+		if !reflect.DeepEqual(l.got, l.want) {
+			t.Errorf("receipt lists %v, want %v", l.got, l.want)
+		}
+	}
+	entries, _ := db.GetAudit("a")
+	last := entries[len(entries) - 1]
+	if last.ID != receipt.AuditID || last.Hash != receipt.AuditHash || last.Action != "close out" {
+		t.Errorf("receipt points at audit entry %d, last is %d %s", receipt.AuditID, last.ID, last.Action)
+	}
+
+	bundle, err := OpenBundle(file, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Hosts) != 1 || bundle.Hosts[0].Ip != "10.0.0.1" || len(bundle.Audit) != 1 ||
+		len(bundle.Users) != 1 || len(bundle.Workers) != 1 {
+		t.Errorf("bundle has %d hosts, %d audit entries, %d users and %d workers",
+			len(bundle.Hosts), len(bundle.Audit), len(bundle.Users), len(bundle.Workers))
+	}
+
+	if n, _ := db.CountHosts("a"); n != 0 {
+		t.Errorf("%d hosts of a left", n)
+	}
+	if _, err := db.GetUser("user-a"); err == nil {
+		t.Error("user of a left")
+	}
+	if _, err := db.GetWorker("worker-a"); err == nil {
+		t.Error("worker of a left")
+	}
+	if _, ok := creds.Get(&scope.Entries[0]); ok {
+		t.Error("credentials of a left")
+	}
+
+	if n, _ := db.CountServices("b"); n != 2 {
+		t.Errorf("%d services of b left, want 2", n)
+	}
+	if _, err := db.GetUser("user-b"); err != nil {
+		t.Error("user of b deleted")
+	}
+	if _, ok := creds.Get(&scope.Entries[1]); !ok {
+		t.Error("credentials of b deleted")
+	}
+	if _, err := os.Stat(screenshotFile("10.1.0.1", "5901")); err != nil {
+		t.Error("screenshot of b deleted")
+	}
+}
+
+// TestCloseOutPartial fails to shred a screenshot, the key to the bundle
+// must still be handed over since the rows are gone.
+func TestCloseOutPartial(t *testing.T) {
+	db, scope, creds := newTestCloseOut(t)
+	os.Mkdir(screenshotFile("10.0.0.1", "5900"), 0700)
+
+	file := filepath.Join(t.TempDir(), "bundle")
+	receipt, key, err := CloseOut(db, scope, creds, "a", file, "test")
+	if err == nil {
+		t.Fatal("shredding a directory succeeded")
+	}
+	if receipt == nil || key == nil || receipt.Error == "" || receipt.AuditID == 0 {
+		t.Fatalf("got receipt %+v and key %v", receipt, key)
+	}
+	if bundle, err := OpenBundle(file, key); err != nil || len(bundle.Hosts) != 1 {
+		t.Errorf("bundle can't be opened: %v", err)
+	}
+	if n, _ := db.CountHosts("a"); n != 0 {
+		t.Errorf("%d hosts of a left", n)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errUsage = errors.New(`usage:
+	vncjew creds set <cidr> [username]   (password is read from stdin)
+	vncjew creds del <cidr>
+	vncjew creds list
+	vncjew users add <name> <engagement>   (password is read from stdin)
+	vncjew users del <name>
+	vncjew users list
+	vncjew rotate admin <name>
+	vncjew ca init <hostname|ip>...
+	vncjew workers enroll <name> <operator> <engagement> <csr file>
+	vncjew workers revoke <name>
+	vncjew workers list
+	vncjew closeout <engagement> <bundle file>
+	vncjew bundle <bundle file>   (key is read from stdin)`)
+
+func runCommand(args []string, db *DB, scope *Scope, creds *CredStore) error {
+	switch args[0] {
+	case "creds": return credsCommand(args[1:], scope, creds)
+	case "users": return usersCommand(args[1:], db, scope)
+	case "rotate": return rotateCommand(args[1:])
+	case "ca": return caCommand(args[1:])
+	case "workers": return workersCommand(args[1:], db, scope)
+	case "closeout": return closeOutCommand(args[1:], db, scope, creds)
+	case "bundle": return bundleCommand(args[1:])
+	}
+	return errUsage
+}
+
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func credsCommand(args []string, scope *Scope, creds *CredStore) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	if args[0] == "list" {
+		keys := creds.Keys()
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Println(k)
+		}
+		return nil
+	}
+	if len(args) < 2 {
+		return errUsage
+	}
+	entry := scope.Entry(args[1])
+	if entry == nil {
+		return fmt.Errorf("%s is not an entry in %s", args[1], CFGScopeFile)
+	}
+
+	switch args[0] {
+	case "set":
+		var cred Credential
+		if len(args) > 2 {
+			cred.Username = args[2]
+		}
+		password, err := readSecret("Password: ")
+		if err != nil {
+			return err
+		}
+		cred.Password = password
+		return creds.Set(entry, cred)
+	case "del":
+		return creds.Delete(entry)
+	}
+	return errUsage
+}
+
+func usersCommand(args []string, db *DB, scope *Scope) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		users, err := db.GetUsers()
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			fmt.Println(u.Name, u.Engagement)
+		}
+		return nil
+	case "add":
+		if len(args) < 3 {
+			return errUsage
+		}
+		if !scope.HasEngagement(args[2]) {
+			return fmt.Errorf("no engagement %s in %s", args[2], CFGScopeFile)
+		}
+		password, err := readSecret("Password: ")
+		if err != nil {
+			return err
+		}
+		if password == "" {
+			return errors.New("empty password")
+		}
+		user := User{Name: args[1], Engagement: args[2]}
+		if err := user.SetPassword(password); err != nil {
+			return err
+		}
+		return db.SaveUser(&user)
+	case "del":
+		if len(args) < 2 {
+			return errUsage
+		}
+		return db.DeleteUser(args[1])
+	}
+	return errUsage
+}
+
+// rotateCommand gives an account a new random password, printing it once
+// and storing only its hash.
+func rotateCommand(args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	if args[0] != "admin" {
+		return errUsage
+	}
+	file, accounts := secretFile(adminAccountsFile), CFGAdminAccount
+	if strings.Contains(args[1], ":") {
+		return errors.New("account names can't contain ':'")
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	password := base64.RawURLEncoding.EncodeToString(b)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	accounts[args[1]] = string(hash)
+	if err := saveAccounts(file, accounts); err != nil {
+		return err
+	}
+	fmt.Printf("New password for %s %s: %s\n", args[0], args[1], password)
+	fmt.Println("Restart the server for it to take effect.")
+	return nil
+}
+
+func caCommand(args []string) error {
+	if len(args) < 2 || args[0] != "init" {
+		return errUsage
+	}
+	if err := InitCA(args[1:]); err != nil {
+		return err
+	}
+	fmt.Println("Wrote", secretFile(caCertFile), CFGTLSCert, CFGTLSKey)
+	return nil
+}
+
+func workersCommand(args []string, db *DB, scope *Scope) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		workers, err := db.GetWorkers()
+		if err != nil {
+			return err
+		}
+		for _, w := range workers {
+			state := "active"
+			if w.Revoked {
+				state = "revoked " + w.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Println(w.Name, w.Operator, w.Engagement, w.Fingerprint, state)
+		}
+		return nil
+	case "enroll":
+		if len(args) < 5 {
+			return errUsage
+		}
+		if !scope.HasEngagement(args[3]) {
+			return fmt.Errorf("no engagement %s in %s", args[3], CFGScopeFile)
+		}
+		if err := EnrollWorker(db, args[1], args[2], args[3], args[4]); err != nil {
+			return err
+		}
+		fmt.Printf("Give %s.crt and %s to the operator of %s\n",
+			args[1], secretFile(caCertFile), args[1])
+		return nil
+	case "revoke":
+		if len(args) < 2 {
+			return errUsage
+		}
+		return RevokeWorker(db, args[1], "cli")
+	}
+	return errUsage
+}
+
+// closeOutCommand hands over and destroys everything about an engagement,
+// the bundle key is only ever printed here.
+func closeOutCommand(args []string, db *DB, scope *Scope, creds *CredStore) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	if args[0] == "" || !scope.HasEngagement(args[0]) {
+		return fmt.Errorf("unknown engagement %q", args[0])
+	}
+	if _, err := os.Stat(args[1]); err == nil {
+		return fmt.Errorf("%s already exists", args[1])
+	}
+	receipt, key, err := CloseOut(db, scope, creds, args[0], args[1], "cli")
+	// once the bundle is written the key is the only way to open it, it is
+	// printed even if destroying the rest failed
+	if receipt != nil {
+		receipt.Print(os.Stdout)
+	}
+	if key != nil {
+		fmt.Println("Bundle key (not stored anywhere):", hex.EncodeToString(key))
+	}
+	return err
+}
+
+func bundleCommand(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	line, err := readSecret("Key: ")
+	if err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return err
+	}
+	bundle, err := OpenBundle(args[0], key)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(bundle)
+}
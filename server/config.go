@@ -1,21 +1,299 @@
 package main
 
-import "time"
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
-var CFGAdminAccount = map[string]string{
-	"admin": "***REMOVED***",
-}
-var CFGClientAccount = map[string]string{
-	"client": "***REMOVED***",
-	"admin": CFGAdminAccount["admin"],
-}
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Accounts map names to bcrypt hashes, they are loaded from CFGSecretsDir.
+var CFGAdminAccount = map[string]string{}
+var CFGIPInfoToken = ""
+var CFGSMTPPassword = ""
+
+var CFGConfigFile = "config.json"
+var CFGSecretsDir = "secrets"
 var CFGMaxVNCConns = 100
 var CFGMaxConcurrentOCR = 1
 var CFGDb = "database.sqlite3"
 var CFGClientPing = 5 * time.Second
 var CFGClientTimeout = 60 * time.Second
-var CFGIPInfoToken = "fd737c5e5030e3"
-var CFGPasswords = []string{"123456", "password", "admin", "user", "default"}
 var CFGVNCTimeout = "15"
 var CFGVNCScreenshotBin = "./vncscreenshot"
 var CFGTesseractBin = "tesseract"
+var CFGCloudOCR = false
+var CFGScopeFile = "scope.txt"
+var CFGRangePrefix = 16
+var CFGDefaultEngagement = "default"
+var CFGCredFile = "creds.enc"
+// Key files default to CFGSecretsDir, see LoadConfig.
+var CFGCredKeyFile = ""
+var CFGRawScreenshotDir = "./raw"
+var CFGBlurRadius = 6
+var CFGRetention = 30 * 24 * time.Hour
+var CFGRetentionInterval = time.Hour
+var CFGProxyKeyFile = ""
+var CFGProxyTokenTTL = time.Minute
+var CFGProxyDialTimeout = 5 * time.Second
+var CFGProxySessionMax = time.Hour
+var CFGProxyCheckInterval = 10 * time.Second
+var CFGSMTPAddr = "localhost:1025"
+var CFGSMTPUsername = ""
+var CFGDisclosureFrom = "security@localhost"
+var CFGDisclosureFallback = ""
+var CFGDisclosureContacts = map[string]string{}
+var CFGRecheckInterval = 7 * 24 * time.Hour
+var CFGRecheckPoll = time.Hour
+var CFGRecheckRetry = 6 * time.Hour
+var CFGOptOutMinPrefix = 16
+var CFGOptOutRateLimit = 5
+var CFGOptOutRateWindow = time.Hour
+var CFGPublicURL = "https://localhost:8080"
+var CFGListenAddr = ":8080"
+var CFGTLSCert = "server.crt"
+var CFGTLSKey = "server.key"
+var CFGCertLifetime = 365 * 24 * time.Hour
+var CFGDefaultLimits = Limits{Rate: 1000, MaxTargets: 1}
+var CFGEngagementLimits = map[string]Limits{}
+var CFGRangeRetry = 30 * time.Second
+
+// configVars are the settings that can be changed from the config file, or
+// from the environment as VNCJEW_<NAME>.
+var configVars = map[string]interface{}{
+	"secrets_dir": &CFGSecretsDir,
+	"max_vnc_conns": &CFGMaxVNCConns,
+	"max_concurrent_ocr": &CFGMaxConcurrentOCR,
+	"db": &CFGDb,
+	"client_ping": &CFGClientPing,
+	"client_timeout": &CFGClientTimeout,
+	"vnc_timeout": &CFGVNCTimeout,
+	"vnc_screenshot_bin": &CFGVNCScreenshotBin,
+	"tesseract_bin": &CFGTesseractBin,
+	"cloud_ocr": &CFGCloudOCR,
+	"scope_file": &CFGScopeFile,
+	"range_prefix": &CFGRangePrefix,
+	"default_engagement": &CFGDefaultEngagement,
+	"cred_file": &CFGCredFile,
+	"cred_key_file": &CFGCredKeyFile,
+	"raw_screenshot_dir": &CFGRawScreenshotDir,
+	"blur_radius": &CFGBlurRadius,
+	"retention": &CFGRetention,
+	"retention_interval": &CFGRetentionInterval,
+	"proxy_key_file": &CFGProxyKeyFile,
+	"proxy_token_ttl": &CFGProxyTokenTTL,
+	"proxy_dial_timeout": &CFGProxyDialTimeout,
+	"proxy_session_max": &CFGProxySessionMax,
+	"proxy_check_interval": &CFGProxyCheckInterval,
+	"smtp_addr": &CFGSMTPAddr,
+	"smtp_username": &CFGSMTPUsername,
+	"disclosure_from": &CFGDisclosureFrom,
+	"disclosure_fallback": &CFGDisclosureFallback,
+	"disclosure_contacts": &CFGDisclosureContacts,
+	"recheck_interval": &CFGRecheckInterval,
+	"recheck_poll": &CFGRecheckPoll,
+	"recheck_retry": &CFGRecheckRetry,
+	"optout_min_prefix": &CFGOptOutMinPrefix,
+	"optout_rate_limit": &CFGOptOutRateLimit,
+	"optout_rate_window": &CFGOptOutRateWindow,
+	"public_url": &CFGPublicURL,
+	"listen_addr": &CFGListenAddr,
+	"tls_cert": &CFGTLSCert,
+	"tls_key": &CFGTLSKey,
+	"cert_lifetime": &CFGCertLifetime,
+	"default_limits": &CFGDefaultLimits,
+	"engagement_limits": &CFGEngagementLimits,
+	"range_retry": &CFGRangeRetry,
+}
+
+// Secrets that must never be accepted, including the ones that used to be
+// compiled in.
+var weakSecrets = []string{"", "admin", "client", "password", "changeme", "fd737c5e5030e3"}
+
+const (
+	adminAccountsFile = "admin_accounts"
+	ipinfoTokenFile = "ipinfo_token"
+	smtpPasswordFile = "smtp_password"
+	credKeyFile = "creds.key"
+	proxyKeyFile = "proxy.key"
+)
+
+// LoadConfig reads the config file if there is one, then the environment,
+// then the secrets.
+func LoadConfig() error {
+	if f := os.Getenv("VNCJEW_CONFIG"); f != "" {
+		CFGConfigFile = f
+	}
+	data, err := os.ReadFile(CFGConfigFile)
+	if err == nil {
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("%s: %w", CFGConfigFile, err)
+		}
+		for name, raw := range values {
+			v, ok := configVars[name]
+			if !ok {
+				return fmt.Errorf("%s: unknown setting %s", CFGConfigFile, name)
+			}
+			var s string
+			if json.Unmarshal(raw, &s) == nil {
+				err = setConfigVar(v, s)
+			} else {
+				err = json.Unmarshal(raw, v)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", CFGConfigFile, name, err)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for name, v := range configVars {
+		env := "VNCJEW_" + strings.ToUpper(name)
+		if s, ok := os.LookupEnv(env); ok {
+			if err := setConfigVar(v, s); err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+
+	for _, k := range []struct{ v *string; name string }{
+		{&CFGCredKeyFile, credKeyFile},
+		{&CFGProxyKeyFile, proxyKeyFile},
+	} {
+		if *k.v != "" {
+			continue
+		}
+		*k.v = secretFile(k.name)
+		// older versions kept keys next to the data they protect
+		if _, err := os.Stat(k.name); err == nil {
+			if _, err := os.Stat(*k.v); errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("move %s to %s", k.name, *k.v)
+			}
+		}
+	}
+
+	return loadSecrets()
+}
+
+func setConfigVar(v interface{}, s string) error {
+	switch v := v.(type) {
+	case *string:
+		*v = s
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*v = n
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*v = d
+	default:
+		return json.Unmarshal([]byte(s), v)
+	}
+	return nil
+}
+
+// readSecretFile refuses secrets that anyone but the owner can read.
+func readSecretFile(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm() & 0077 != 0 {
+		return "", fmt.Errorf("%s is accessible by group or others, chmod 600 it", file)
+	}
+	data, err := os.ReadFile(file)
+	return strings.TrimSpace(string(data)), err
+}
+
+func secretFile(name string) string {
+	return filepath.Join(CFGSecretsDir, name)
+}
+
+func loadSecrets() error {
+	var err error
+	CFGAdminAccount, err = loadAccounts(secretFile(adminAccountsFile))
+	if err != nil {
+		return err
+	}
+	CFGIPInfoToken, err = readSecretFile(secretFile(ipinfoTokenFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	CFGSMTPPassword, err = readSecretFile(secretFile(smtpPasswordFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// loadAccounts reads name:bcrypt-hash lines.
+func loadAccounts(file string) (map[string]string, error) {
+	accounts := make(map[string]string)
+	data, err := readSecretFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return accounts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		name, hash, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected name:hash", file)
+		}
+		accounts[name] = hash
+	}
+	return accounts, nil
+}
+
+func saveAccounts(file string, accounts map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for name, hash := range accounts {
+		fmt.Fprintf(&b, "%s:%s\n", name, hash)
+	}
+	if err := os.WriteFile(file, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Chmod(file, 0600)
+}
+
+// CheckSecrets is what keeps the server from starting without real secrets.
+func CheckSecrets() error {
+	if len(CFGAdminAccount) == 0 {
+		return fmt.Errorf("no admin accounts in %s, run: vncjew rotate admin <name>",
+			secretFile(adminAccountsFile))
+	}
+	for name, hash := range CFGAdminAccount {
+		for _, weak := range weakSecrets {
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(weak)) == nil {
+				return fmt.Errorf("account %s has a default or empty password", name)
+			}
+		}
+	}
+	for _, weak := range weakSecrets {
+		if CFGIPInfoToken == weak {
+			return fmt.Errorf("%s is missing or a default", secretFile(ipinfoTokenFile))
+		}
+	}
+	if _, err := os.Stat(secretFile(caCertFile)); err != nil {
+		return fmt.Errorf("no worker CA in %s, run: vncjew ca init <hostname>", CFGSecretsDir)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// restoreConfig puts back the settings LoadConfig may change.
+func restoreConfig(t *testing.T) {
+	db, prefix, secrets, file := CFGDb, CFGRangePrefix, CFGSecretsDir, CFGConfigFile
+	credKey, proxyKey := CFGCredKeyFile, CFGProxyKeyFile
+	admins, ipinfo := CFGAdminAccount, CFGIPInfoToken
+	t.Cleanup(func() {
+		CFGDb, CFGRangePrefix, CFGSecretsDir, CFGConfigFile = db, prefix, secrets, file
+		CFGCredKeyFile, CFGProxyKeyFile = credKey, proxyKey
+		CFGAdminAccount, CFGIPInfoToken = admins, ipinfo
+	})
+}
+
+func TestLoadConfig(t *testing.T) {
+	chdirTemp(t)
+	restoreConfig(t)
+	CFGCredKeyFile, CFGProxyKeyFile = "", ""
+	os.WriteFile("config.json", []byte(`{"db": "file.sqlite3", "range_prefix": 20, "secrets_dir": "s"}`), 0600)
+	t.Setenv("VNCJEW_CONFIG", "config.json")
+	t.Setenv("VNCJEW_DB", "env.sqlite3")
+
+	if err := LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if CFGDb != "env.sqlite3" || CFGRangePrefix != 20 {
+		t.Errorf("db %s, range prefix %d", CFGDb, CFGRangePrefix)
+	}
+	if CFGCredKeyFile != filepath.Join("s", "creds.key") || CFGProxyKeyFile != filepath.Join("s", "proxy.key") {
+		t.Errorf("keys default to %s and %s", CFGCredKeyFile, CFGProxyKeyFile)
+	}
+
+	// a key left where older versions kept it has to be moved
+	CFGCredKeyFile, CFGProxyKeyFile = "", ""
+	os.WriteFile("creds.key", []byte("x"), 0600)
+	if err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "move creds.key") {
+		t.Errorf("old key file: %v", err)
+	}
+
+	os.WriteFile("config.json", []byte(`{"no_such_setting": 1}`), 0600)
+	if err := LoadConfig(); err == nil {
+		t.Error("unknown setting accepted")
+	}
+}
+
+func TestReadSecretFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(file, []byte("s3cret\n"), 0644)
+	if _, err := readSecretFile(file); err == nil {
+		t.Error("read a world readable secret")
+	}
+	os.Chmod(file, 0640)
+	if _, err := readSecretFile(file); err == nil {
+		t.Error("read a group readable secret")
+	}
+	os.Chmod(file, 0600)
+	if s, err := readSecretFile(file); err != nil || s != "s3cret" {
+		t.Errorf("readSecretFile = %q, %v", s, err)
+	}
+}
+
+func TestCheckSecrets(t *testing.T) {
+	restoreConfig(t)
+	CFGSecretsDir = t.TempDir()
+	hash := func(password string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(h)
+	}
+
+	CFGAdminAccount, CFGIPInfoToken = map[string]string{}, "token"
+	if err := CheckSecrets(); err == nil {
+		t.Error("accepted no admin accounts")
+	}
+	CFGAdminAccount = map[string]string{"admin": hash("admin")}
+	if err := CheckSecrets(); err == nil {
+		t.Error("accepted a default admin password")
+	}
+	CFGAdminAccount = map[string]string{"admin": hash("a long random password")}
+	CFGIPInfoToken = ""
+	if err := CheckSecrets(); err == nil {
+		t.Error("accepted a missing ipinfo token")
+	}
+	CFGIPInfoToken = "token"
+	if err := CheckSecrets(); err == nil {
+		t.Error("accepted a missing CA")
+	}
+	os.WriteFile(secretFile(caCertFile), nil, 0644)
+	if err := CheckSecrets(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type Credential struct {
+	Username string
+	Password string
+}
+
+// CredStore holds the credentials the asset owners gave us, keyed by the
+// scope entry they apply to. It is kept AES-GCM encrypted on disk.
+type CredStore struct {
+	file string
+	key []byte
+	mu sync.Mutex
+	creds map[string]Credential
+}
+
+func LoadCredStore(file, keyFile string) (*CredStore, error) {
+	key, err := loadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cs := &CredStore{
+		file: file,
+		key: key,
+		creds: make(map[string]Credential),
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return cs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	plain, err := decrypt(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return cs, json.Unmarshal(plain, &cs.creds)
+}
+
+// loadKey reads a hex encoded 256 bit key, generating one if the file does
+// not exist yet.
+func loadKey(file string) ([]byte, error) {
+	data, err := readSecretFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return nil, err
+		}
+		return key, os.WriteFile(file, []byte(hex.EncodeToString(key)), 0600)
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	return key, nil
+}
+
+func encrypt(key, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func decrypt(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func (cs *CredStore) save() error {
+	plain, err := json.Marshal(cs.creds)
+	if err != nil {
+		return err
+	}
+	data, err := encrypt(cs.key, plain)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cs.file, data, 0600)
+}
+
+func (cs *CredStore) Get(entry *ScopeEntry) (*Credential, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.creds[entry.Net.String()]
+	return &c, ok
+}
+
+func (cs *CredStore) Set(entry *ScopeEntry, c Credential) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.creds[entry.Net.String()] = c
+	return cs.save()
+}
+
+func (cs *CredStore) Delete(entry *ScopeEntry) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.creds, entry.Net.String())
+	return cs.save()
+}
+
+func (cs *CredStore) Keys() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	keys := make([]string, 0, len(cs.creds))
+	for k := range cs.creds {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCredStore(t *testing.T) {
+	dir := t.TempDir()
+	file, keyFile := filepath.Join(dir, "creds.enc"), filepath.Join(dir, "secrets", "creds.key")
+	cs, err := LoadCredStore(file, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	entry := &ScopeEntry{Net: n, Engagement: "a"}
+	if err := cs.Set(entry, Credential{"user", "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("hunter2")) {
+		t.Error("password stored in the clear")
+	}
+	if info, _ := os.Stat(keyFile); info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %o", info.Mode().Perm())
+	}
+
+	cs, err = LoadCredStore(file, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := cs.Get(entry); !ok || *c != (Credential{"user", "hunter2"}) {
+		t.Errorf("Get = %v, %v after reloading", c, ok)
+	}
+
+	os.Remove(keyFile)
+	if _, err := LoadCredStore(file, keyFile); err == nil {
+		t.Error("decrypted with a new key")
+	}
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/participle/v2/lexer"
@@ -18,6 +18,7 @@ import (
 
 type DB struct {
 	db *gorm.DB
+	auditMu sync.Mutex
 }
 
 type Host struct {
@@ -28,6 +29,8 @@ type Host struct {
 	City string
 	Region string
 	Hostname string
+	Abuse string
+	Engagement string `gorm:"index"`
 	Services []Service `gorm:"foreignKey:HostIp"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
@@ -37,7 +40,6 @@ type Service struct {
 	HostIp string `gorm:"primaryKey"`
 	Port uint16 `gorm:"primaryKey"`
 	Username string
-	Password string
 	ClientName string
 	Text string
 	CreatedAt time.Time
@@ -45,44 +47,63 @@ type Service struct {
 	Width int
 	Height int
 	Type string
+	AuthRequired bool
 }
 
-var ipClient = ipinfo.NewClient(nil, nil, CFGIPInfoToken)
+var ipClient *ipinfo.Client
 
 func NewDB() (*DB, error) {
-	db, err := gorm.Open(sqlite.Open(CFGDb), &gorm.Config{})
+	ipClient = ipinfo.NewClient(nil, nil, CFGIPInfoToken)
+	// secure_delete zeroes deleted rows instead of leaving them in free pages,
+	// immediate transactions and busy_timeout let commands write alongside
+	// the running server
+	dsn := CFGDb + "?_pragma=secure_delete(1)&_pragma=busy_timeout(10000)&_txlock=immediate"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
-	db.AutoMigrate(&Host{}, &Service{})
+	db.AutoMigrate(&Host{}, &Service{}, &User{}, &ProxySession{}, &AuditEntry{}, &Finding{}, &OptOut{}, &Worker{})
+	// AutoMigrate never drops columns, and this one held guessed passwords
+	if db.Migrator().HasColumn(&Service{}, "password") {
+		if err := db.Migrator().DropColumn(&Service{}, "password"); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range auditTriggers {
+		if err := db.Exec(t).Error; err != nil {
+			return nil, err
+		}
+	}
 	sql, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
 	sql.SetMaxOpenConns(1) // so that sqlite never locks...?
-	return &DB{db}, nil
+	return &DB{db: db}, nil
 }
 
 var sqlLexer = lexer.MustSimple([]lexer.SimpleRule{
-	{"SQL", `\d+|host\.ip|host\.asn|host\.org|host\.country|host\.city` +
+	{Name: "SQL", Pattern: `\d+|host\.ip|host\.asn|host\.org|host\.country|host\.city` +
 		`|host\.region|host\.hostname|host\.created_at|host\.updated_at` +
-		`|username|password|text|client_name|port|services\.created_at` +
+		`|username|auth_required|text|client_name|port|services\.created_at` +
 		`|services\.updated_at|width|height` +
 		`|BETWEEN|ORDER|NULL|LIKE|ASC|DESC|NOT|AND|OR|BY|IS|RANDOM\(\)|>=|<=|=|<>|<|>`},
-	{"String", `"(\\"|[^"])*"`},
-	{"whitespace", `[ \t\r\n]+`},
+	{Name: "String", Pattern: `"(\\"|[^"])*"`},
+	{Name: "whitespace", Pattern: `[ \t\r\n]+`},
 })
 var tokSQL = sqlLexer.Symbols()["SQL"]
 var tokString = sqlLexer.Symbols()["String"]
 
-func (db *DB) Search(query string, offset, amount int) ([]Service, error) {
+func (db *DB) Search(query, engagement string, offset, amount int) ([]Service, error) {
 	lex, err := sqlLexer.Lex("", strings.NewReader(query))
 	if err != nil {
 		return nil, err
 	}
 
-	var sql strings.Builder
+	// everything from ORDER on is the sort, it must not end up in WHERE
+	var sql, order strings.Builder
 	var sqlArgs []interface{}
+	out := &sql
 
 	for {
 		token, err := lex.Next()
@@ -94,9 +115,15 @@ func (db *DB) Search(query string, offset, amount int) ([]Service, error) {
 		}
 
 		if token.Type == tokSQL {
-			sql.WriteString(token.Value)
-			sql.WriteRune(' ')
+			if token.Value == "ORDER" {
+				out = &order
+			}
+			out.WriteString(token.Value)
+			out.WriteRune(' ')
 		} else if token.Type == tokString {
+			if out == &order {
+				return nil, errors.New("strings are not allowed in ORDER BY")
+			}
 			var val string
 			if token.Value[0] == '"' {
 				val = token.Value[1:][:len(token.Value) - 2]
@@ -109,15 +136,24 @@ func (db *DB) Search(query string, offset, amount int) ([]Service, error) {
 		}
 	}
 
-	q1 := db.db.Offset(offset).Limit(amount)
-	q := q1.Joins("JOIN hosts host ON host.ip = host_ip").Where(sql.String(), sqlArgs...)
+	q := db.db.Offset(offset).Limit(amount).Joins("JOIN hosts host ON host.ip = host_ip")
+	if engagement != "" {
+		q = q.Where("host.engagement = ?", engagement)
+	}
+	if sql.Len() > 0 {
+		// the parentheses keep an OR in the query from escaping the filter
+		q = q.Where(clause.Expr{SQL: "(" + sql.String() + ")", Vars: sqlArgs})
+	}
+	if order.Len() > 0 {
+		q = q.Order(strings.TrimPrefix(strings.TrimSpace(order.String()), "ORDER BY "))
+	}
 	var services []Service
 
 	err = q.Find(&services).Error
 	return services, err
 }
 
-func (db *DB) AddService(ip, port, ocr string, info *VNCInfo) error {
+func (db *DB) AddService(ip, port, engagement, ocr string, info *VNCInfo) error {
 	ipInfo, err := ipClient.GetIPInfo(net.ParseIP(ip))
 	if err != nil {
 		return err
@@ -133,6 +169,10 @@ func (db *DB) AddService(ip, port, ocr string, info *VNCInfo) error {
 	uport := uint16(_port)
 
 	splitOrg := strings.Split(ipInfo.Org, " ")
+	abuse := ""
+	if ipInfo.Abuse != nil {
+		abuse = ipInfo.Abuse.Email
+	}
 
 	err = db.db.Clauses(clause.OnConflict{
 		UpdateAll: true,
@@ -144,6 +184,8 @@ func (db *DB) AddService(ip, port, ocr string, info *VNCInfo) error {
 		City: ipInfo.City,
 		Region: ipInfo.Region,
 		Hostname: ipInfo.Hostname,
+		Abuse: abuse,
+		Engagement: engagement,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}).Error
@@ -158,7 +200,6 @@ func (db *DB) AddService(ip, port, ocr string, info *VNCInfo) error {
 		HostIp: ip,
 		Port: uport,
 		Username: info.Username,
-		Password: info.Password,
 		ClientName: info.ClientName,
 		Text: ocr,
 		Width: info.Width,
@@ -166,16 +207,21 @@ func (db *DB) AddService(ip, port, ocr string, info *VNCInfo) error {
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 		Type: "VNC",
+		AuthRequired: info.AuthRequired,
 	}).Error
 
 	return err
 }
 
-func (db *DB) GetHost(ip string) (Host, error) {
+func (db *DB) GetHost(ip, engagement string) (Host, error) {
 	var host Host
-	err := db.db.Preload("Services", func(db *gorm.DB) *gorm.DB {
+	q := db.db.Preload("Services", func(db *gorm.DB) *gorm.DB {
 		return db.Order("port")
-	}).First(&host, "ip = ?", ip).Error
+	})
+	if engagement != "" {
+		q = q.Where("engagement = ?", engagement)
+	}
+	err := q.First(&host, "ip = ?", ip).Error
 
 	return host, err
 }
@@ -211,17 +257,229 @@ func (db *DB) DeleteService(ip string, port string) error {
 			return err
 		}
 	}
-	return os.Remove(fmt.Sprintf("./screenshots/%s_%s.jpeg", ip, port))
+	err = os.Remove(screenshotFile(ip, port))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// PurgeHost removes a host along with its screenshots and findings.
+func (db *DB) PurgeHost(ip string) error {
+	if err := db.DeleteHost(ip); err != nil {
+		return err
+	}
+	return db.db.Where("host_ip = ?", ip).Delete(&Finding{}).Error
+}
+
+// DeleteEngagement removes every host of an engagement along with its
+// services, findings, users and workers, the screenshots are left to the
+// caller.
+func (db *DB) DeleteEngagement(engagement string) error {
+	return db.db.Transaction(func(tx *gorm.DB) error {
+		hosts := tx.Model(&Host{}).Select("ip").Where("engagement = ?", engagement)
+		err := tx.Unscoped().Where("host_ip IN (?)", hosts).Delete(&Service{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Unscoped().Where("engagement = ?", engagement).Delete(&Finding{}).Error
+		if err != nil {
+			return err
+		}
+		// its accounts go too, deleted workers are refused and dropped
+		err = tx.Where("engagement = ?", engagement).Delete(&User{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("engagement = ?", engagement).Delete(&Worker{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("engagement = ?", engagement).Delete(&Host{}).Error
+	})
+}
+
+func (db *DB) GetHostIPs() ([]string, error) {
+	var ips []string
+	err := db.db.Model(&Host{}).Pluck("ip", &ips).Error
+	return ips, err
+}
+
+// ExportEngagement fills b with everything kept about exactly one
+// engagement, unlike the getters an empty name never means all of them.
+func (db *DB) ExportEngagement(b *Bundle) error {
+	if b.Engagement == "" {
+		return errors.New("no engagement given")
+	}
+	q := db.db.Where("engagement = ?", b.Engagement)
+	err := q.Session(&gorm.Session{}).Preload("Services").Find(&b.Hosts).Error
+	if err == nil {
+		err = q.Session(&gorm.Session{}).Order("id").Find(&b.Findings).Error
+	}
+	if err == nil {
+		err = q.Session(&gorm.Session{}).Order("id").Find(&b.Audit).Error
+	}
+	if err == nil {
+		err = q.Session(&gorm.Session{}).Model(&User{}).Order("name").Pluck("name", &b.Users).Error
+	}
+	if err == nil {
+		err = q.Session(&gorm.Session{}).Order("name").Find(&b.Workers).Error
+	}
+	return err
 }
 
-func (db *DB) GetHosts() ([]Host, error) {
+func (db *DB) GetHosts(engagement string) ([]Host, error) {
 	var hosts []Host
-	err := db.db.Preload("Services").Find(&hosts).Error
+	q := db.db.Preload("Services")
+	if engagement != "" {
+		q = q.Where("engagement = ?", engagement)
+	}
+	err := q.Find(&hosts).Error
 
 	return hosts, err
 }
 
-func (db *DB) Count(v interface{}) (int64, error) {
+func (db *DB) CountHosts(engagement string) (int64, error) {
+	var n int64
+	q := db.db.Model(&Host{})
+	if engagement != "" {
+		q = q.Where("engagement = ?", engagement)
+	}
+	return n, q.Count(&n).Error
+}
+
+func (db *DB) CountServices(engagement string) (int64, error) {
 	var n int64
-	return n, db.db.Model(v).Count(&n).Error
+	q := db.db.Model(&Service{})
+	if engagement != "" {
+		q = q.Joins("JOIN hosts host ON host.ip = host_ip").Where("host.engagement = ?", engagement)
+	}
+	return n, q.Count(&n).Error
+}
+
+func (db *DB) AddProxySession(s *ProxySession) error {
+	return db.db.Create(s).Error
+}
+
+func (db *DB) SaveProxySession(s *ProxySession) error {
+	return db.db.Save(s).Error
+}
+
+// AddFinding stores f unless there already is a finding for its target.
+func (db *DB) AddFinding(f *Finding) (bool, error) {
+	res := db.db.Clauses(clause.OnConflict{DoNothing: true}).Create(f)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (db *DB) GetFinding(id string) (Finding, error) {
+	var f Finding
+	err := db.db.First(&f, "id = ?", id).Error
+	return f, err
+}
+
+func (db *DB) GetFindings(engagement string) ([]Finding, error) {
+	var findings []Finding
+	q := db.db.Order("id")
+	if engagement != "" {
+		q = q.Where("engagement = ?", engagement)
+	}
+	err := q.Find(&findings).Error
+	return findings, err
+}
+
+func (db *DB) GetDueFindings(now time.Time) ([]Finding, error) {
+	var findings []Finding
+	err := db.db.Where("state IN ? AND recheck_at < ?",
+		[]string{FindingNotified, FindingAcknowledged}, now).Find(&findings).Error
+	return findings, err
+}
+
+// MoveFinding stores the state and times of f, but only if the finding is
+// still in one of the states from. It reports whether it was.
+func (db *DB) MoveFinding(f *Finding, from ...string) (bool, error) {
+	res := db.db.Model(&Finding{}).Where("id = ? AND state IN ?", f.ID, from).
+		Select("state", "notified_at", "recheck_at", "checked_at").Updates(f)
+	return res.RowsAffected == 1, res.Error
+}
+
+func (db *DB) GetOptOuts() ([]OptOut, error) {
+	var list []OptOut
+	err := db.db.Order("id").Find(&list).Error
+	return list, err
+}
+
+// FindOptOut returns the entry for exactly cidr, or nil if there is none.
+func (db *DB) FindOptOut(cidr string) (*OptOut, error) {
+	var list []OptOut
+	err := db.db.Where(&OptOut{CIDR: cidr}).Limit(1).Find(&list).Error
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return &list[0], nil
+}
+
+func (db *DB) GetOptOut(id string) (OptOut, error) {
+	var e OptOut
+	err := db.db.Where("id = ?", id).First(&e).Error
+	return e, err
+}
+
+func (db *DB) GetOptOutByVerifyHash(hash string) (OptOut, error) {
+	var e OptOut
+	err := db.db.Where("verify_hash = ? AND verify_hash <> ''", hash).First(&e).Error
+	return e, err
+}
+
+func (db *DB) SaveOptOut(e *OptOut) error {
+	return db.db.Save(e).Error
+}
+
+func (db *DB) DeleteOptOut(id string) error {
+	return db.db.Where("id = ?", id).Delete(&OptOut{}).Error
+}
+
+func (db *DB) GetUser(name string) (User, error) {
+	var user User
+	err := db.db.First(&user, "name = ?", name).Error
+	return user, err
+}
+
+func (db *DB) GetUsers() ([]User, error) {
+	var users []User
+	err := db.db.Order("name").Find(&users).Error
+	return users, err
+}
+
+func (db *DB) SaveUser(user *User) error {
+	return db.db.Save(user).Error
+}
+
+func (db *DB) DeleteUser(name string) error {
+	return db.db.Where("name = ?", name).Delete(&User{}).Error
+}
+
+func (db *DB) PurgeText(before time.Time) error {
+	return db.db.Model(&Service{}).Where("updated_at < ? AND text <> ''", before).Update("text", "").Error
+}
+
+func (db *DB) GetWorker(name string) (Worker, error) {
+	var worker Worker
+	err := db.db.Where("name = ?", name).First(&worker).Error
+	return worker, err
+}
+
+func (db *DB) GetWorkerByFingerprint(fingerprint string) (Worker, error) {
+	var worker Worker
+	err := db.db.Where("fingerprint = ?", fingerprint).First(&worker).Error
+	return worker, err
+}
+
+func (db *DB) GetWorkers() ([]Worker, error) {
+	var workers []Worker
+	err := db.db.Order("name").Find(&workers).Error
+	return workers, err
+}
+
+func (db *DB) SaveWorker(worker *Worker) error {
+	return db.db.Save(worker).Error
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestDB(t *testing.T) *DB {
+	CFGDb = filepath.Join(t.TempDir(), "test.sqlite3")
+	db, err := NewDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func addTestHost(t *testing.T, db *DB, ip, engagement string, ports ...uint16) {
+	host := Host{Ip: ip, Engagement: engagement}
+	for _, p := range ports {
+		host.Services = append(host.Services, Service{Port: p, Text: "x"})
+	}
+	if err := db.db.Create(&host).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchEngagement(t *testing.T) {
+	db := newTestDB(t)
+	addTestHost(t, db, "10.0.0.1", "a", 5900)
+	addTestHost(t, db, "10.1.0.1", "b", 5901, 5902)
+
+	for _, query := range []string{
+		``,
+		`text LIKE "%x%"`,
+		`text LIKE "%x%" ORDER BY port`,
+		`text LIKE "%x%" ORDER BY port DESC`,
+		`port = 5901 OR port = 5902`,
+		`text LIKE "%x%" OR 1 = 1 ORDER BY RANDOM()`,
+	} {
+		services, err := db.Search(query, "a", 0, 25)
+		if err != nil {
+			t.Errorf("%q: %v", query, err)
+			continue
+		}
+		for _, s := range services {
+			if s.HostIp != "10.0.0.1" {
+				t.Errorf("%q: got %s from another engagement", query, s.HostIp)
+			}
+		}
+	}
+
+	services, err := db.Search(`text LIKE "%x%" ORDER BY port DESC`, "", 0, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 3 || services[0].Port != 5902 {
+		t.Errorf("admin search got %v, want all 3 services sorted by port descending", services)
+	}
+}
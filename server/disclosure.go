@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FindingNew = "new"
+	FindingNotified = "notified"
+	FindingAcknowledged = "acknowledged"
+	FindingRemediated = "remediated"
+)
+
+var errNoContact = errors.New("No contact for finding")
+var errNotNew = errors.New("Finding was already notified")
+
+// findingFrom lists the states a finding may be moved to by hand from,
+// notifying goes through NotifyFinding and nothing leaves remediated.
+var findingFrom = map[string][]string{
+	FindingAcknowledged: {FindingNotified},
+	FindingRemediated: {FindingNew, FindingNotified, FindingAcknowledged},
+}
+
+// Finding is a VNC server that let us in without a password, and where we
+// are in telling its owner about it.
+type Finding struct {
+	ID uint `gorm:"primaryKey"`
+	HostIp string `gorm:"uniqueIndex:finding_target"`
+	Port uint16 `gorm:"uniqueIndex:finding_target"`
+	Engagement string `gorm:"index"`
+	State string
+	Contact string
+	Subject string
+	Body string
+	NotifiedAt time.Time
+	RecheckAt time.Time
+	CheckedAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// findingContact picks who to notify, the abuse contact ipinfo gave us for
+// the host first, then whatever is configured for its ASN or organization.
+func findingContact(host *Host) string {
+	if host.Abuse != "" {
+		return host.Abuse
+	}
+	if c, ok := CFGDisclosureContacts[host.Asn]; ok {
+		return c
+	}
+	if c, ok := CFGDisclosureContacts[host.Org]; ok {
+		return c
+	}
+	return CFGDisclosureFallback
+}
+
+// OpenFinding drafts a notification for an unauthenticated VNC on ip:port.
+// Nothing is sent until an admin asks for it.
+func OpenFinding(db *DB, ip string, port uint16) error {
+	host, err := db.GetHost(ip, "")
+	if err != nil {
+		return err
+	}
+	target := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	f := Finding{
+		HostIp: ip,
+		Port: port,
+		Engagement: host.Engagement,
+		State: FindingNew,
+		Contact: findingContact(&host),
+		Subject: fmt.Sprintf("Unauthenticated VNC service on %s", target),
+		Body: fmt.Sprintf(`Hello,
+
+During the authorized security assessment "%s" we found a VNC remote
+desktop service on %s (%s, %s) that accepts connections without
+a password. Anyone who can reach it can see and control the desktop.
+
+First observed: %s
+
+We recommend requiring a strong password or restricting access to the
+service with a firewall or VPN. We will re-check the service in %d days
+and let you know whether it is still exposed.
+
+Please reply to this message to acknowledge it.
+`, host.Engagement, target, host.Org, host.Asn,
+			time.Now().UTC().Format(time.RFC1123), int(CFGRecheckInterval.Hours() / 24)),
+	}
+	created, err := db.AddFinding(&f)
+	if err == nil && created {
+		db.Audit(AuditEntry{
+			Engagement: f.Engagement,
+			Actor: "server",
+			Action: "finding",
+			Target: target,
+			Result: "drafted notification to " + f.Contact,
+		})
+	}
+	return err
+}
+
+// sendMail sends a plain text message from CFGDisclosureFrom.
+func sendMail(to, subject, body string) error {
+	msg := strings.Join([]string{
+		"From: " + CFGDisclosureFrom,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	var auth smtp.Auth
+	if CFGSMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(CFGSMTPAddr)
+		auth = smtp.PlainAuth("", CFGSMTPUsername, CFGSMTPPassword, host)
+	}
+	return smtp.SendMail(CFGSMTPAddr, auth, CFGDisclosureFrom, []string{to}, []byte(msg))
+}
+
+// NotifyFinding sends the drafted notification from the outbox and
+// schedules a re-check. The finding is claimed before sending so that
+// concurrent requests can't both send it, and given back if sending fails.
+func NotifyFinding(db *DB, f *Finding, actor string) error {
+	if f.Contact == "" {
+		return errNoContact
+	}
+	claim := *f
+	claim.State = FindingNotified
+	claim.NotifiedAt = time.Now()
+	claim.RecheckAt = claim.NotifiedAt.Add(CFGRecheckInterval)
+	claimed, err := db.MoveFinding(&claim, FindingNew)
+	if err != nil {
+		return err
+	} else if !claimed {
+		return errNotNew
+	}
+
+	err = sendMail(f.Contact, f.Subject, f.Body)
+	db.Audit(AuditEntry{
+		Engagement: f.Engagement,
+		Actor: actor,
+		Action: "notify",
+		Target: net.JoinHostPort(f.HostIp, strconv.Itoa(int(f.Port))),
+		Result: auditResult(err),
+	})
+	if err != nil {
+		f.State = FindingNew
+		f.NotifiedAt, f.RecheckAt = time.Time{}, time.Time{}
+		if _, merr := db.MoveFinding(f, FindingNotified); merr != nil {
+			log.Printf("Finding %d: %s", f.ID, merr.Error())
+		}
+		return err
+	}
+	*f = claim
+	return nil
+}
+
+// SetFindingState moves a finding along by hand, notifying goes through
+// NotifyFinding instead.
+func SetFindingState(db *DB, f *Finding, state, actor string) error {
+	from, ok := findingFrom[state]
+	if !ok {
+		return fmt.Errorf("invalid state %q", state)
+	}
+	prev := f.State
+	f.State = state
+	moved, err := db.MoveFinding(f, from...)
+	if err == nil && !moved {
+		err = fmt.Errorf("finding can't go from %s to %s", prev, state)
+		f.State = prev
+	}
+	db.Audit(AuditEntry{
+		Engagement: f.Engagement,
+		Actor: actor,
+		Action: "finding " + state,
+		Target: net.JoinHostPort(f.HostIp, strconv.Itoa(int(f.Port))),
+		Result: auditResult(err),
+	})
+	return err
+}
+
+// recheckFinding only repeats the banner exchange, it never authenticates
+// or takes a screenshot. A finding is only closed when the server now asks
+// for authentication, failing to reach it says nothing about whether it was
+// fixed so it is just tried again later.
+func recheckFinding(db *DB, scope *Scope, f *Finding) {
+	target := net.JoinHostPort(f.HostIp, strconv.Itoa(int(f.Port)))
+	f.CheckedAt = time.Now()
+	f.RecheckAt = f.CheckedAt.Add(CFGRecheckInterval)
+
+	var result string
+	if _, err := scope.Check(f.HostIp); err != nil {
+		result = "skipped: " + err.Error()
+	} else if types, err := vncAuthTypes(f.HostIp, strconv.Itoa(int(f.Port))); err != nil {
+		f.RecheckAt = f.CheckedAt.Add(CFGRecheckRetry)
+		result = "unreachable, retrying: " + err.Error()
+	} else if bytes.IndexByte(types, rfbSecNone) < 0 {
+		f.State = FindingRemediated
+		result = "remediated"
+	} else {
+		result = "still exposed"
+	}
+
+	db.Audit(AuditEntry{
+		Engagement: f.Engagement,
+		Actor: "server",
+		Action: "recheck",
+		Target: target,
+		Result: result,
+	})
+	// an admin may have moved it on meanwhile
+	if moved, err := db.MoveFinding(f, FindingNotified, FindingAcknowledged); err != nil {
+		log.Printf("%s %s", target, err.Error())
+	} else if !moved {
+		log.Printf("%s no longer due for a recheck", target)
+	}
+}
+
+func RecheckLoop(db *DB, scope *Scope) {
+	for {
+		findings, err := db.GetDueFindings(time.Now())
+		if err != nil {
+			log.Println(err)
+		}
+		for i := range findings {
+			recheckFinding(db, scope, &findings[i])
+		}
+		time.Sleep(CFGRecheckPoll)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStub accepts messages and sends what it got on the channel.
+func smtpStub(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	msgs := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go smtpSession(conn, msgs)
+		}
+	}()
+	return l.Addr().String(), msgs
+}
+
+func smtpSession(conn net.Conn, msgs chan string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { io.WriteString(conn, s + "\r\n") }
+	reply("220 stub")
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 stub")
+		case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+			data.WriteString(line)
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			reply("250 queued")
+			msgs <- data.String()
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func openTestFinding(t *testing.T, db *DB, ip string, port uint16) Finding {
+	err := db.db.Create(&Host{Ip: ip, Engagement: "a", Abuse: "abuse@example.com"}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenFinding(db, ip, port); err != nil {
+		t.Fatal(err)
+	}
+	findings, err := db.GetFindings("a")
+	if err != nil || len(findings) != 1 {
+		t.Fatalf("got %v %v, want one finding", findings, err)
+	}
+	return findings[0]
+}
+
+func TestNotifyFinding(t *testing.T) {
+	db := newTestDB(t)
+	var msgs chan string
+	CFGSMTPAddr, msgs = smtpStub(t)
+	CFGSMTPUsername = ""
+	f := openTestFinding(t, db, "10.0.0.1", 5900)
+	if f.State != FindingNew || f.Contact != "abuse@example.com" {
+		t.Fatalf("drafted finding is %s to %q", f.State, f.Contact)
+	}
+
+	if err := NotifyFinding(db, &f, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	for _, want := range []string{
+		"RCPT TO:<abuse@example.com>",
+		"To: abuse@example.com",
+		"Subject: Unauthenticated VNC service on 10.0.0.1:5900",
+		"accepts connections without",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+
+	saved, err := db.GetFinding(strconv.Itoa(int(f.ID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.State != FindingNotified || saved.RecheckAt.Before(time.Now().Add(CFGRecheckInterval - time.Minute)) {
+		t.Errorf("after notifying state is %s, recheck at %s", saved.State, saved.RecheckAt)
+	}
+	if err := NotifyFinding(db, &saved, "admin"); err != errNotNew {
+		t.Errorf("notifying again returned %v, want %v", err, errNotNew)
+	}
+}
+
+// TestNotifyFindingOnce sends two notifications for the same finding at
+// once, as two admins clicking at the same time would.
+func TestNotifyFindingOnce(t *testing.T) {
+	db := newTestDB(t)
+	var msgs chan string
+	CFGSMTPAddr, msgs = smtpStub(t)
+	f := openTestFinding(t, db, "10.0.0.1", 5900)
+	a, b := f, f
+	errs := make(chan error, 2)
+	go func() { errs <- NotifyFinding(db, &a, "admin") }()
+	go func() { errs <- NotifyFinding(db, &b, "admin") }()
+	sent := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			sent++
+		} else if err != errNotNew {
+			t.Fatal(err)
+		}
+	}
+	if sent != 1 || len(msgs) != 1 {
+		t.Errorf("notified %d times, %d messages sent", sent, len(msgs))
+	}
+
+	// a failed send leaves the finding to be notified again
+	db = newTestDB(t)
+	g := openTestFinding(t, db, "10.0.0.2", 5900)
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	CFGSMTPAddr = closed.Addr().String()
+	closed.Close()
+	if err := NotifyFinding(db, &g, "admin"); err == nil {
+		t.Fatal("notified without a mail server")
+	}
+	saved, _ := db.GetFinding(strconv.Itoa(int(g.ID)))
+	if saved.State != FindingNew || !saved.RecheckAt.IsZero() {
+		t.Errorf("after a failed send state is %s, recheck at %s", saved.State, saved.RecheckAt)
+	}
+}
+
+func TestSetFindingState(t *testing.T) {
+	db := newTestDB(t)
+	f := openTestFinding(t, db, "10.0.0.1", 5900)
+	for _, c := range []struct {
+		state string
+		ok bool
+	}{
+		{FindingAcknowledged, false},
+		{FindingNotified, false},
+		{FindingRemediated, true},
+		{FindingAcknowledged, false},
+		{FindingRemediated, false},
+	} {
+		err := SetFindingState(db, &f, c.state, "admin")
+		if (err == nil) != c.ok {
+			t.Errorf("moving to %s: %v", c.state, err)
+		}
+		saved, _ := db.GetFinding(strconv.Itoa(int(f.ID)))
+		if saved.State != f.State {
+			t.Errorf("finding is %s in the database, %s in memory", saved.State, f.State)
+		}
+	}
+}
+
+// vncStub answers the banner exchange on every connection, offering types.
+func vncStub(t *testing.T, types ...byte) uint16 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "RFB 003.008\n")
+			io.ReadFull(conn, make([]byte, 12))
+			conn.Write(append([]byte{byte(len(types))}, types...))
+			conn.Close()
+		}
+	}()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestRecheckFinding(t *testing.T) {
+	scope, err := LoadScope(writeScope(t, "127.0.0.1 a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := uint16(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+
+	for _, c := range []struct {
+		name string
+		ip string
+		port uint16
+		state string
+		retry bool
+	}{
+		{"auth required", "127.0.0.1", vncStub(t, rfbSecVNC), FindingRemediated, false},
+		{"still open", "127.0.0.1", vncStub(t, rfbSecVNC, rfbSecNone), FindingNotified, false},
+		{"unreachable", "127.0.0.1", closedPort, FindingNotified, true},
+		{"out of scope", "127.0.0.2", closedPort, FindingNotified, false},
+	} {
+		db := newTestDB(t)
+		f := Finding{HostIp: c.ip, Port: c.port, State: FindingNotified}
+		if _, err := db.AddFinding(&f); err != nil {
+			t.Fatal(err)
+		}
+		recheckFinding(db, scope, &f)
+		saved, _ := db.GetFinding(strconv.Itoa(int(f.ID)))
+		if f.State != c.state || saved.State != c.state {
+			t.Errorf("%s: state %s, saved %s, want %s", c.name, f.State, saved.State, c.state)
+		}
+		if retry := f.RecheckAt.Sub(f.CheckedAt) == CFGRecheckRetry; retry != c.retry {
+			t.Errorf("%s: recheck in %s", c.name, f.RecheckAt.Sub(f.CheckedAt))
+		}
+	}
+}
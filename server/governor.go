@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits keep a scan from degrading the network it is aimed at. Rate is the
+// ceiling in packets per second for the whole engagement, split evenly
+// between the at most MaxTargets ranges of it scanned at once. MaxTargets
+// also caps the VNC connections made to its hosts at once. Windows are the
+// daily "15:04-15:04" UTC maintenance windows scanning is allowed in (none
+// means any time).
+type Limits struct {
+	Rate int `json:"rate"`
+	MaxTargets int `json:"max_targets"`
+	Windows []string `json:"windows"`
+}
+
+type window struct {
+	start, end time.Duration
+}
+
+// limitsFor fills in whatever an engagement doesn't set from CFGDefaultLimits.
+func limitsFor(engagement string) Limits {
+	l, ok := CFGEngagementLimits[engagement]
+	if !ok {
+		return CFGDefaultLimits
+	}
+	if l.Rate <= 0 {
+		l.Rate = CFGDefaultLimits.Rate
+	}
+	if l.MaxTargets <= 0 {
+		l.MaxTargets = CFGDefaultLimits.MaxTargets
+	}
+	if l.Windows == nil {
+		l.Windows = CFGDefaultLimits.Windows
+	}
+	return l
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour()) * time.Hour + time.Duration(t.Minute()) * time.Minute, nil
+}
+
+func parseWindow(s string) (window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return window{}, fmt.Errorf("invalid window %q, expected 15:04-15:04", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return window{}, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return window{}, err
+	}
+	return window{start, end}, nil
+}
+
+// CheckLimits validates the limits so mistakes show up at startup.
+func CheckLimits() error {
+	all := map[string]Limits{"default": CFGDefaultLimits}
+	for name, l := range CFGEngagementLimits {
+		all[name] = l
+	}
+	for name, l := range all {
+		for _, w := range l.Windows {
+			if _, err := parseWindow(w); err != nil {
+				return fmt.Errorf("limits for %s: %w", name, err)
+			}
+		}
+	}
+	if CFGDefaultLimits.Rate <= 0 || CFGDefaultLimits.MaxTargets <= 0 {
+		return fmt.Errorf("default rate and max targets must be positive")
+	}
+	// every range has to get at least 1 pps
+	if CFGDefaultLimits.Rate < CFGDefaultLimits.MaxTargets {
+		return fmt.Errorf("default rate must be at least max targets")
+	}
+	for name := range CFGEngagementLimits {
+		if l := limitsFor(name); l.Rate < l.MaxTargets {
+			return fmt.Errorf("limits for %s: rate must be at least max targets", name)
+		}
+	}
+	return nil
+}
+
+// TargetRate is the share of Rate each range gets, so all of them together
+// stay under it.
+func (l Limits) TargetRate() int {
+	return l.Rate / l.MaxTargets
+}
+
+// Open reports whether scanning is allowed at now, and until when. When it
+// isn't, the time it next will be is returned instead. A zero time means
+// there is no end.
+func (l Limits) Open(now time.Time) (bool, time.Time) {
+	if len(l.Windows) == 0 {
+		return true, time.Time{}
+	}
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var next time.Time
+	// yesterday's window may still be running past midnight
+	for _, d := range []int{-1, 0, 1} {
+		base := day.AddDate(0, 0, d)
+		for _, s := range l.Windows {
+			w, _ := parseWindow(s)
+			start, end := base.Add(w.start), base.Add(w.end)
+			if !end.After(start) {
+				end = end.AddDate(0, 0, 1)
+			}
+			if !now.Before(start) && now.Before(end) {
+				return true, end
+			}
+			if start.After(now) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+	return false, next
+}
+
+// Governor counts the ranges each engagement is being scanned in.
+type Governor struct {
+	mu sync.Mutex
+	active map[string]int
+}
+
+func NewGovernor() *Governor {
+	return &Governor{active: make(map[string]int)}
+}
+
+// Acquire takes a slot for engagement, or says how long to wait for one.
+func (g *Governor) Acquire(engagement string, now time.Time) (Limits, time.Time, time.Duration) {
+	l := limitsFor(engagement)
+	open, until := l.Open(now)
+	if !open {
+		return l, until, until.Sub(now)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.active[engagement] >= l.MaxTargets {
+		return l, until, CFGRangeRetry
+	}
+	g.active[engagement]++
+	return l, until, 0
+}
+
+func (g *Governor) Release(engagement string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.active[engagement] > 0 {
+		g.active[engagement]--
+	}
+}
+
+// targetConns holds a semaphore per engagement for the VNC connections made
+// to its hosts, like vLimit does for all of them.
+var targetConns = struct {
+	mu sync.Mutex
+	sem map[string]chan struct{}
+}{sem: make(map[string]chan struct{})}
+
+func tAcquire(engagement string) {
+	targetConns.mu.Lock()
+	sem, ok := targetConns.sem[engagement]
+	if !ok {
+		sem = make(chan struct{}, limitsFor(engagement).MaxTargets)
+		targetConns.sem[engagement] = sem
+	}
+	targetConns.mu.Unlock()
+	sem <- struct{}{}
+}
+
+func tRelease(engagement string) {
+	targetConns.mu.Lock()
+	sem := targetConns.sem[engagement]
+	targetConns.mu.Unlock()
+	<-sem
+}
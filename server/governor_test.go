@@ -0,0 +1,192 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitsOpen(t *testing.T) {
+	l := Limits{Windows: []string{"22:00-06:00", "12:00-13:00"}}
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	for _, c := range []struct {
+		now string
+		open bool
+		at string
+	}{
+		{"2026-01-01T23:00:00Z", true, "2026-01-02T06:00:00Z"},
+		{"2026-01-01T03:00:00Z", true, "2026-01-01T06:00:00Z"},
+		{"2026-01-01T06:00:00Z", false, "2026-01-01T12:00:00Z"},
+		{"2026-01-01T12:30:00Z", true, "2026-01-01T13:00:00Z"},
+		{"2026-01-01T14:00:00Z", false, "2026-01-01T22:00:00Z"},
+	} {
+		open, next := l.Open(at(c.now))
+		if open != c.open || !next.Equal(at(c.at)) {
+			t.Errorf("Open(%s) = %v, %s, want %v, %s", c.now, open, next, c.open, c.at)
+		}
+	}
+	if open, until := (Limits{}).Open(time.Now()); !open || !until.IsZero() {
+		t.Error("limits without windows should always be open")
+	}
+}
+
+func TestGovernor(t *testing.T) {
+	CFGDefaultLimits = Limits{Rate: 1000, MaxTargets: 4}
+	CFGEngagementLimits = map[string]Limits{"a": {MaxTargets: 1}}
+	defer func() {
+		CFGDefaultLimits = Limits{Rate: 1000, MaxTargets: 1}
+		CFGEngagementLimits = map[string]Limits{}
+	}()
+
+	g := NewGovernor()
+	now := time.Now()
+	l, _, wait := g.Acquire("a", now)
+	if wait != 0 || l.TargetRate() != 1000 {
+		t.Fatalf("first acquire waits %s at rate %d", wait, l.TargetRate())
+	}
+	if _, _, wait := g.Acquire("a", now); wait != CFGRangeRetry {
+		t.Errorf("acquire beyond max targets waits %s", wait)
+	}
+	// b gets the default limits, its ceiling is shared by 4 ranges
+	for i := 0; i < 4; i++ {
+		if l, _, wait := g.Acquire("b", now); wait != 0 || l.TargetRate() != 250 {
+			t.Errorf("other engagement waits %s at rate %d", wait, l.TargetRate())
+		}
+	}
+	if _, _, wait := g.Acquire("b", now); wait == 0 {
+		t.Error("acquired beyond the default max targets")
+	}
+	g.Release("a")
+	if _, _, wait := g.Acquire("a", now); wait != 0 {
+		t.Errorf("acquire after release waits %s", wait)
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	defer func() {
+		CFGDefaultLimits = Limits{Rate: 1000, MaxTargets: 1}
+		CFGEngagementLimits = map[string]Limits{}
+	}()
+	for _, c := range []struct {
+		def Limits
+		engagements map[string]Limits
+		ok bool
+	}{
+		{Limits{Rate: 1000, MaxTargets: 1}, nil, true},
+		{Limits{Rate: 1000, MaxTargets: 1}, map[string]Limits{"a": {Rate: 10, MaxTargets: 5}}, true},
+		{Limits{Rate: 1000}, nil, false},
+		{Limits{Rate: 1000, MaxTargets: 1}, map[string]Limits{"a": {Rate: 2, MaxTargets: 5}}, false},
+		{Limits{Rate: 1000, MaxTargets: 1}, map[string]Limits{"a": {Windows: []string{"22:00"}}}, false},
+	} {
+		CFGDefaultLimits, CFGEngagementLimits = c.def, c.engagements
+		if err := CheckLimits(); (err == nil) != c.ok {
+			t.Errorf("CheckLimits(%v, %v) = %v", c.def, c.engagements, err)
+		}
+	}
+}
+
+// TestRelease has the range released for the operator stopping the scan
+// while the worker disconnects, the slot must only be given back once.
+func TestRelease(t *testing.T) {
+	CFGDefaultLimits = Limits{Rate: 1000, MaxTargets: 2}
+	defer func() { CFGDefaultLimits = Limits{Rate: 1000, MaxTargets: 1} }()
+	s := &WSServ{Db: newTestDB(t), Governor: NewGovernor(), Clients: make(map[*Client]struct{})}
+	// another worker holds the other slot
+	s.Governor.Acquire("a", time.Now())
+	for i := 0; i < 50; i++ {
+		if _, _, wait := s.Governor.Acquire("a", time.Now()); wait != 0 {
+			t.Fatalf("slot not given back after %d runs", i)
+		}
+		c := &Client{Worker: &Worker{Name: "w"}, Range: &Range{"10.0.0.0/16", "a"}}
+		s.mu.Lock()
+		s.Clients[c] = struct{}{}
+		s.mu.Unlock()
+		done := make(chan struct{})
+		go func() {
+			for _, c := range s.clients() {
+				s.release(c, false, "stopped")
+			}
+			close(done)
+		}()
+		s.release(c, true, "returned unfinished")
+		<-done
+		s.mu.Lock()
+		delete(s.Clients, c)
+		s.mu.Unlock()
+		if _, _, wait := s.Governor.Acquire("a", time.Now()); wait != 0 {
+			t.Fatal("slot not given back")
+		}
+		if _, _, wait := s.Governor.Acquire("a", time.Now()); wait == 0 {
+			t.Fatal("slot given back twice")
+		}
+		s.Governor.Release("a")
+	}
+}
+
+func TestReturnRange(t *testing.T) {
+	s := &WSServ{Ranges: map[string][]Range{
+		"a": {{"10.0.0.0/16", "a"}, {"10.1.0.0/16", "a"}},
+	}}
+	r, _ := s.nextRange("a")
+	s.returnRange(r)
+	if next, _ := s.nextRange("a"); next != r {
+		t.Errorf("got %v after returning %v", next, r)
+	}
+	if _, ok := s.nextRange("b"); ok {
+		t.Error("got a range of another engagement")
+	}
+	if n := s.rangesLeft(); n != 1 {
+		t.Errorf("%d ranges left, want 1", n)
+	}
+}
+
+func TestTargetConns(t *testing.T) {
+	CFGEngagementLimits = map[string]Limits{"conns": {MaxTargets: 1}}
+	defer func() { CFGEngagementLimits = map[string]Limits{} }()
+	tAcquire("conns")
+	acquired := make(chan struct{})
+	go func() {
+		tAcquire("conns")
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("connected beyond max targets")
+	case <-time.After(50 * time.Millisecond):
+	}
+	tRelease("conns")
+	<-acquired
+	tRelease("conns")
+}
+
+func TestReleaseAudit(t *testing.T) {
+	s := &WSServ{Db: newTestDB(t), Governor: NewGovernor()}
+	c := &Client{Worker: &Worker{Name: "w"}}
+	for _, r := range []struct {
+		requeue bool
+		result string
+	}{
+		{false, "finished"},
+		{true, "returned unfinished"},
+	} {
+		c.Range = &Range{"10.0.0.0/16", "a"}
+		s.release(c, r.requeue, r.result)
+	}
+	entries, err := s.Db.GetAudit("a")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("%d audit entries, %v", len(entries), err)
+	}
+	for i, want := range []string{"finished", "returned unfinished"} {
+		if e := entries[i]; e.Action != "range" || e.Target != "10.0.0.0/16" || e.Result != want {
+			t.Errorf("entry %d is %s %s %s, want range 10.0.0.0/16 %s", i, e.Action, e.Target, e.Result, want)
+		}
+	}
+	if n := s.rangesLeft(); n != 1 {
+		t.Errorf("%d ranges queued, want the unfinished one", n)
+	}
+}
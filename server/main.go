@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/evangwt/go-vncproxy"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/net/websocket"
 )
@@ -16,37 +19,197 @@ func errorMSG(c *gin.Context, err error) {
 	c.String(http.StatusInternalServerError, "%s", err.Error())
 }
 
+// auditRequest records an action taken by whoever made the request.
+func auditRequest(c *gin.Context, db *DB, engagement, action, target string, err error) {
+	actor := c.GetString(gin.AuthUserKey)
+	if u, ok := c.Get("account"); ok {
+		actor = u.(*User).Name
+	}
+	db.Audit(AuditEntry{
+		Engagement: engagement,
+		Actor: actor,
+		Action: action,
+		Target: target,
+		Result: auditResult(err),
+	})
+}
+
+// parseScreenshotFile splits a screenshot name like 1.2.3.4_5900.jpeg.
+func parseScreenshotFile(file string) (string, string, bool) {
+	if !strings.HasSuffix(file, ".jpeg") {
+		return "", "", false
+	}
+	name := strings.TrimSuffix(file, ".jpeg")
+	i := strings.LastIndexByte(name, '_')
+	if i < 0 || net.ParseIP(name[:i]) == nil {
+		return "", "", false
+	}
+	if _, err := strconv.ParseUint(name[i + 1:], 10, 16); err != nil {
+		return "", "", false
+	}
+	return name[:i], name[i + 1:], true
+}
+
 func main() {
+	if err := LoadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	vLimit = make(chan struct{}, CFGMaxVNCConns)
+	oLimit = make(chan struct{}, CFGMaxConcurrentOCR)
+
+	db, err := NewDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scope, err := LoadScope(CFGScopeFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scope.OptOuts, err = LoadOptOuts(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	creds, err := LoadCredStore(CFGCredFile, CFGCredKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:], db, scope, creds); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := CheckSecrets(); err != nil {
+		log.Fatal(err)
+	}
+	if err := CheckLimits(); err != nil {
+		log.Fatal(err)
+	}
+
 	r := gin.Default()
 	r.LoadHTMLGlob("templates/*")
 	r.StaticFile("/favicon.ico", "./res/favicon.ico")
-	os.Mkdir("./screenshots", os.ModePerm)
-	r.Static("/screenshots", "./screenshots")
-	r.Static("/novnc", "./novnc")
+	// Mkdir leaves existing directories alone, older versions made them 0777
+	for _, dir := range []string{"./screenshots", CFGRawScreenshotDir} {
+		os.Mkdir(dir, 0700)
+		if err := os.Chmod(dir, 0700); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := RedactExisting(); err != nil {
+		log.Fatal(err)
+	}
 
-	db, err := NewDB()
+	go RetentionLoop(db)
+	go RecheckLoop(db, scope)
+
+	wsServ := NewWSServ(db, scope, creds)
+
+	user := authUser(db)
+	admin := authAccounts(CFGAdminAccount)
+	worker := authWorker(db)
+
+	tlsConfig, err := TLSConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	wsServ := NewWSServ(db)
+	vncProxy, err := NewVNCProxy(CFGProxyKeyFile, db, scope)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	admin := gin.BasicAuth(CFGAdminAccount)
-	client := gin.BasicAuth(CFGClientAccount)
+	r.Group("/novnc", user).Static("/", "./novnc")
+
+	r.GET("/screenshots/:file", user, func(c *gin.Context) {
+		ip, port, ok := parseScreenshotFile(c.Param("file"))
+		if !ok {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		_, err := db.GetHost(ip, engagement(c))
+		auditRequest(c, db, scope.EngagementOf(ip), "view screenshot", net.JoinHostPort(ip, port), err)
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.File(screenshotFile(ip, port))
+	})
+
+	// the opt out form is the one page owners need without an account
+	r.GET("/optout", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "optout.html", gin.H{})
+	})
+
+	// limits both the requests from each source and the mail sent to each
+	// contact
+	optOutLimit := newSourceLimiter(CFGOptOutRateLimit, CFGOptOutRateWindow)
+	optOutSource := func(c *gin.Context) bool {
+		source, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
+		if !optOutLimit.Allow(source, time.Now()) {
+			c.HTML(http.StatusTooManyRequests, "optout.html", gin.H{"error": errTooManyRequests.Error()})
+			return false
+		}
+		return true
+	}
+
+	r.POST("/optout", func(c *gin.Context) {
+		if !optOutSource(c) {
+			return
+		}
+		req, err := CheckRequest(c.PostForm("cidr"), c.PostForm("contact"), c.PostForm("reason"))
+		var e *OptOut
+		if err == nil && !optOutLimit.Allow("contact " + req.Contact, time.Now()) {
+			err = errTooManyRequests
+		} else if err == nil {
+			e, err = scope.OptOuts.Request(req)
+			db.Audit(AuditEntry{
+				Actor: req.Contact,
+				Action: "request opt out",
+				Target: req.CIDR,
+				Result: auditResult(err),
+			})
+		}
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "optout.html", gin.H{"error": err.Error()})
+			return
+		}
+		c.HTML(http.StatusOK, "optout.html", gin.H{"requested": e.CIDR, "contact": e.Contact})
+	})
 
-	vncProxy := vncproxy.New(&vncproxy.Config{
-		TokenHandler: func(r *http.Request) (string, error) {
-			return r.URL.Query().Get("token"), nil
-		},
+	r.GET("/optout/verify", func(c *gin.Context) {
+		if !optOutSource(c) {
+			return
+		}
+		e, err := scope.OptOuts.Verify(c.Query("token"))
+		// tokens that match nothing aren't worth a record
+		if e != nil {
+			db.Audit(AuditEntry{
+				Actor: e.Contact,
+				Action: "verify opt out",
+				Target: e.CIDR,
+				Result: auditResult(err),
+			})
+		}
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "optout.html", gin.H{"error": err.Error()})
+			return
+		}
+		c.HTML(http.StatusOK, "optout.html", gin.H{"verified": e.CIDR})
 	})
 
-	r.GET("/", func(c *gin.Context) {
-		hosts, err := db.Count(&Host{})
+	r.GET("/", user, func(c *gin.Context) {
+		hosts, err := db.CountHosts(engagement(c))
 		if err != nil {
 			errorMSG(c, err)
 			return
 		}
-		services, err := db.Count(&Service{})
+		services, err := db.CountServices(engagement(c))
 		if err != nil {
 			errorMSG(c, err)
 			return
@@ -58,7 +221,7 @@ func main() {
 		})
 	})
 
-	r.GET("/search", func(c *gin.Context) {
+	r.GET("/search", user, func(c *gin.Context) {
 		offset, _ := strconv.Atoi(c.Query("offset"))
 		if offset < 0 {
 			offset = 0
@@ -68,7 +231,7 @@ func main() {
 			amt = 25
 		}
 
-		services, err := db.Search(c.Query("query"), offset, amt)
+		services, err := db.Search(c.Query("query"), engagement(c), offset, amt)
 		if err != nil {
 			errorMSG(c, err)
 			return
@@ -82,7 +245,7 @@ func main() {
 		})
 	})
 
-	r.GET("/api/search", func(c *gin.Context) {
+	r.GET("/api/search", user, func(c *gin.Context) {
 		offset, _ := strconv.Atoi(c.Query("offset"))
 		if offset < 0 {
 			offset = 0
@@ -92,7 +255,7 @@ func main() {
 			amt = 25
 		}
 
-		services, err := db.Search(c.Query("query"), offset, amt)
+		services, err := db.Search(c.Query("query"), engagement(c), offset, amt)
 		if err != nil {
 			errorMSG(c, err)
 			return
@@ -101,8 +264,9 @@ func main() {
 		c.JSON(http.StatusOK, services)
 	})
 
-	r.GET("/host/:ip", func(c *gin.Context) {
-		host, err := db.GetHost(c.Param("ip"))
+	r.GET("/host/:ip", user, func(c *gin.Context) {
+		host, err := db.GetHost(c.Param("ip"), engagement(c))
+		auditRequest(c, db, scope.EngagementOf(c.Param("ip")), "view host", c.Param("ip"), err)
 		if err != nil {
 			errorMSG(c, err)
 			return
@@ -114,21 +278,40 @@ func main() {
 	})
 
 	r.GET("/admin/status", admin, func(c *gin.Context) {
+		workers, err := db.GetWorkers()
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
 		c.HTML(http.StatusOK, "admin_status.html", gin.H{
 			"clients": wsServ.SendStatus(),
+			"workers": workers,
 		})
 	})
 
+	r.POST("/admin/workers/revoke", admin, func(c *gin.Context) {
+		err := RevokeWorker(db, c.PostForm("name"), c.GetString(gin.AuthUserKey))
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		wsServ.Revoke(c.PostForm("name"))
+		c.String(http.StatusOK, "Revoked %s", c.PostForm("name"))
+	})
+
 	r.GET("/admin/start", admin, func(c *gin.Context) {
+		auditRequest(c, db, "", "start", "all clients", nil)
 		c.String(http.StatusOK, "%s", wsServ.SendStart())
 	})
 
 	r.GET("/admin/stop", admin, func(c *gin.Context) {
+		auditRequest(c, db, "", "stop", "all clients", nil)
 		c.String(http.StatusOK, "%s", wsServ.SendStop())
 	})
 
 	r.POST("/admin/deleteHost", admin, func(c *gin.Context) {
 		err := db.DeleteHost(c.PostForm("ip"))
+		auditRequest(c, db, scope.EngagementOf(c.PostForm("ip")), "delete host", c.PostForm("ip"), err)
 		if err != nil {
 			errorMSG(c, err)
 			return
@@ -138,6 +321,8 @@ func main() {
 
 	r.POST("/admin/deleteService", admin, func(c *gin.Context) {
 		err := db.DeleteService(c.PostForm("ip"), c.PostForm("port"))
+		auditRequest(c, db, scope.EngagementOf(c.PostForm("ip")), "delete service",
+			net.JoinHostPort(c.PostForm("ip"), c.PostForm("port")), err)
 		if err != nil {
 			errorMSG(c, err)
 			return
@@ -146,8 +331,9 @@ func main() {
 	})
 
 	r.POST("/admin/refresh", admin, func(c *gin.Context) {
-		err := AddVNC(c.PostForm("ip"), c.PostForm("port"),
-			c.PostForm("username"), c.PostForm("password"), db)
+		err := AddVNC(c.PostForm("ip"), c.PostForm("port"), c.GetString(gin.AuthUserKey), db, scope, creds)
+		auditRequest(c, db, scope.EngagementOf(c.PostForm("ip")), "refresh",
+			net.JoinHostPort(c.PostForm("ip"), c.PostForm("port")), err)
 		if err != nil {
 			errorMSG(c, err)
 		} else {
@@ -155,8 +341,113 @@ func main() {
 		}
 	})
 
-	r.GET("/api/database", func(c *gin.Context) {
-		hosts, err := db.GetHosts()
+	r.GET("/admin/findings", admin, func(c *gin.Context) {
+		findings, err := db.GetFindings(c.Query("engagement"))
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		c.HTML(http.StatusOK, "admin_findings.html", gin.H{
+			"findings": findings,
+		})
+	})
+
+	r.POST("/admin/findings/notify", admin, func(c *gin.Context) {
+		f, err := db.GetFinding(c.PostForm("id"))
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		err = NotifyFinding(db, &f, c.GetString(gin.AuthUserKey))
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		c.String(http.StatusOK, "Notified %s", f.Contact)
+	})
+
+	r.POST("/admin/findings/state", admin, func(c *gin.Context) {
+		f, err := db.GetFinding(c.PostForm("id"))
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		err = SetFindingState(db, &f, c.PostForm("state"), c.GetString(gin.AuthUserKey))
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		c.String(http.StatusOK, "Finding is now %s", f.State)
+	})
+
+	r.GET("/admin/optouts", admin, func(c *gin.Context) {
+		list, err := db.GetOptOuts()
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		c.HTML(http.StatusOK, "admin_optouts.html", gin.H{
+			"optouts": list,
+		})
+	})
+
+	r.POST("/admin/optouts/add", admin, func(c *gin.Context) {
+		e, err := scope.OptOuts.Add(c.PostForm("cidr"), c.PostForm("contact"), c.PostForm("reason"))
+		auditRequest(c, db, "", "opt out", c.PostForm("cidr"), err)
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		wsServ.SendExclude()
+		c.String(http.StatusOK, "Opted out %s", e.CIDR)
+	})
+
+	r.POST("/admin/optouts/approve", admin, func(c *gin.Context) {
+		e, err := scope.OptOuts.Approve(c.PostForm("id"))
+		target := c.PostForm("id")
+		if e != nil {
+			target = e.CIDR
+		}
+		auditRequest(c, db, "", "approve opt out", target, err)
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		wsServ.SendExclude()
+		c.String(http.StatusOK, "Opted out %s", e.CIDR)
+	})
+
+	r.POST("/admin/optouts/delete", admin, func(c *gin.Context) {
+		err := scope.OptOuts.Delete(c.PostForm("id"))
+		auditRequest(c, db, "", "delete opt out", c.PostForm("id"), err)
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		wsServ.SendExclude()
+		c.String(http.StatusOK, "Successfully deleted opt out")
+	})
+
+	r.GET("/admin/audit", admin, func(c *gin.Context) {
+		entries, err := db.GetAudit(c.Query("engagement"))
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		verified := "ok"
+		if err := db.VerifyAudit(); err != nil {
+			verified = err.Error()
+		}
+		auditRequest(c, db, c.Query("engagement"), "export audit", "", nil)
+		c.JSON(http.StatusOK, gin.H{
+			"verified": verified,
+			"entries": entries,
+		})
+	})
+
+	r.GET("/api/database", user, func(c *gin.Context) {
+		hosts, err := db.GetHosts(engagement(c))
+		auditRequest(c, db, engagement(c), "export database", "", err)
 		if err != nil {
 			errorMSG(c, err)
 			return
@@ -169,13 +460,71 @@ func main() {
 		c.String(http.StatusOK, "%s", m)
 	})
 
-	r.GET("/api/client", client, func(c *gin.Context) {
-		websocket.Handler(wsServ.ServeWS).ServeHTTP(c.Writer, c.Request)
+	r.GET("/api/client", worker, func(c *gin.Context) {
+		w := c.MustGet("worker").(*Worker)
+		websocket.Handler(func(ws *websocket.Conn) {
+			wsServ.ServeWS(ws, w)
+		}).ServeHTTP(c.Writer, c.Request)
+	})
+
+	r.GET("/connect/:ip/:port", user, func(c *gin.Context) {
+		ip, port := c.Param("ip"), c.Param("port")
+		entry, err := scope.Check(ip)
+		if err != nil {
+			c.String(http.StatusForbidden, "%s", err.Error())
+			return
+		}
+		if !getUser(c).Admin && entry.Engagement != engagement(c) {
+			c.String(http.StatusForbidden, "%s", errOutOfScope.Error())
+			return
+		}
+		host, err := db.GetHost(ip, engagement(c))
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		var service *Service
+		for i := range host.Services {
+			if strconv.Itoa(int(host.Services[i].Port)) == port {
+				service = &host.Services[i]
+			}
+		}
+		if service == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		// only admins may take control, everyone else just watches
+		viewOnly := !getUser(c).Admin || c.Query("control") != "1"
+		token, err := vncProxy.Issue(getUser(c).Name, entry.Engagement, net.JoinHostPort(ip, port), viewOnly)
+		auditRequest(c, db, entry.Engagement, "connect", net.JoinHostPort(ip, port), err)
+		if err != nil {
+			errorMSG(c, err)
+			return
+		}
+		q := url.Values{
+			"path": {"websockify?token=" + token},
+			"username": {service.Username},
+			"view_only": {strconv.FormatBool(viewOnly)},
+		}
+		c.Redirect(http.StatusFound, "/novnc/vnc.html?" + q.Encode())
 	})
 
-	r.GET("/websockify", func(c *gin.Context) {
-		websocket.Handler(vncProxy.ServeWS).ServeHTTP(c.Writer, c.Request)
+	r.GET("/websockify", user, func(c *gin.Context) {
+		token, err := vncProxy.Verify(c.Query("token"))
+		if err != nil || token.User != getUser(c).Name {
+			c.String(http.StatusForbidden, "%s", errBadToken.Error())
+			return
+		}
+		websocket.Handler(func(ws *websocket.Conn) {
+			vncProxy.ServeWS(ws, token)
+		}).ServeHTTP(c.Writer, c.Request)
 	})
 
-	log.Fatal(r.Run())
+	srv := &http.Server{
+		Addr: CFGListenAddr,
+		Handler: r,
+		TLSConfig: tlsConfig,
+	}
+	log.Fatal(srv.ListenAndServeTLS(CFGTLSCert, CFGTLSKey))
 }
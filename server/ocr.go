@@ -9,7 +9,7 @@ import (
 	vision "cloud.google.com/go/vision/apiv1"
 )
 
-var oLimit = make(chan struct{}, CFGMaxConcurrentOCR)
+var oLimit chan struct{}
 func oAcquire() { oLimit <- struct{}{} }
 func oRelease() { <-oLimit }
 
@@ -49,9 +49,14 @@ func tesseractOCR(file string) string {
 	return string(text)
 }
 
+// OCR reads the text off a raw screenshot. Only tesseract is used unless
+// CFGCloudOCR is set, since that uploads the unredacted image to Google.
 func OCR(file string) string {
 	oAcquire()
 	defer oRelease()
+	if !CFGCloudOCR {
+		return tesseractOCR(file)
+	}
 	res, err := googleOCR(file)
 	if err != nil {
 		log.Println(err)
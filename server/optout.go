@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errOptedOut = errors.New("Target opted out")
+var errBadVerifyToken = errors.New("Invalid or used verification link")
+var errNotVerified = errors.New("Opt out contact has not been verified")
+var errOptOutExists = errors.New("Network already opted out or waiting for approval")
+var errTooManyRequests = errors.New("Too many requests, try again later")
+
+// Limits on what the public form accepts, anything it stores or audits is
+// bounded by them.
+const (
+	maxOptOutCIDR = 43
+	maxOptOutContact = 254
+	maxOptOutReason = 1000
+)
+
+const (
+	OptOutPending = "pending"
+	OptOutApproved = "approved"
+)
+
+// OptOut is a network whose owner asked us not to scan it. Requests from the
+// public form stay pending, and are not enforced, until the contact has
+// confirmed them by email and an admin approved them.
+type OptOut struct {
+	ID uint `gorm:"primaryKey"`
+	CIDR string `gorm:"uniqueIndex"`
+	Contact string
+	Reason string
+	// entries from before approvals existed were all enforced
+	Status string `gorm:"default:approved"`
+	Verified bool
+	VerifyHash string `json:"-"`
+	CreatedAt time.Time
+}
+
+// OptOuts keeps the registry from the database in memory since it is checked
+// for every target.
+type OptOuts struct {
+	mu sync.RWMutex
+	nets []*net.IPNet
+	db *DB
+}
+
+func LoadOptOuts(db *DB) (*OptOuts, error) {
+	o := &OptOuts{db: db}
+	return o, o.reload()
+}
+
+func (o *OptOuts) reload() error {
+	list, err := o.db.GetOptOuts()
+	if err != nil {
+		return err
+	}
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, e := range list {
+		if e.Status != OptOutApproved {
+			continue
+		}
+		ipnet, err := parseCIDR(e.CIDR)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, ipnet)
+	}
+	o.mu.Lock()
+	o.nets = nets
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *OptOuts) Contains(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for _, n := range o.nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers reports whether all of cidr is opted out.
+func (o *OptOuts) Covers(cidr string) bool {
+	ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	ones, _ := ipnet.Mask.Size()
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for _, n := range o.nets {
+		nOnes, _ := n.Mask.Size()
+		if nOnes <= ones && n.Contains(ipnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *OptOuts) CIDRs() []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	res := make([]string, len(o.nets))
+	for i, n := range o.nets {
+		res[i] = n.String()
+	}
+	return res
+}
+
+// Add registers an opt out from an admin and enforces it straight away, a
+// request already made for the network is approved with the admin's
+// details.
+func (o *OptOuts) Add(cidr, contact, reason string) (*OptOut, error) {
+	ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	e, err := o.db.FindOptOut(ipnet.String())
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		e = &OptOut{CIDR: ipnet.String()}
+	}
+	e.Contact = contact
+	e.Reason = reason
+	e.Verified = true
+	e.VerifyHash = ""
+	return e, o.approve(e)
+}
+
+// CheckRequest validates an opt out from the public form, nothing is
+// recorded about requests that fail it.
+func CheckRequest(cidr, contact, reason string) (*OptOut, error) {
+	if len(cidr) > maxOptOutCIDR || len(contact) > maxOptOutContact || len(reason) > maxOptOutReason {
+		return nil, errors.New("Request too long")
+	}
+	ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	// anything bigger has to go through an admin
+	if ones, bits := ipnet.Mask.Size(); bits - ones > 32 - CFGOptOutMinPrefix {
+		return nil, fmt.Errorf("Networks larger than /%d have to be added by an admin", CFGOptOutMinPrefix)
+	}
+	addr, err := mail.ParseAddress(contact)
+	if err != nil {
+		return nil, fmt.Errorf("invalid contact email: %w", err)
+	}
+	return &OptOut{CIDR: ipnet.String(), Contact: addr.Address, Reason: reason}, nil
+}
+
+// Request records an opt out checked by CheckRequest and mails the contact a
+// link to confirm it. Nothing is enforced or deleted until an admin
+// approves it. An unconfirmed request doesn't hold the network, a later
+// one replaces it so nobody can block the real owner.
+func (o *OptOuts) Request(req *OptOut) (*OptOut, error) {
+	e, err := o.db.FindOptOut(req.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		e = &OptOut{CIDR: req.CIDR}
+	} else if e.Verified || e.Status == OptOutApproved {
+		return nil, errOptOutExists
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	e.Contact = req.Contact
+	e.Reason = req.Reason
+	e.Status = OptOutPending
+	e.VerifyHash = verifyHash(hex.EncodeToString(token))
+	if err := o.db.SaveOptOut(e); err != nil {
+		return nil, err
+	}
+	err = sendMail(e.Contact, "Confirm your opt out request for " + e.CIDR, fmt.Sprintf(`Hello,
+
+Someone asked us not to scan %s, giving this address as the contact.
+If that was you, confirm the request by opening this link:
+
+%s/optout/verify?token=%s
+
+If it wasn't, ignore this message and nothing will change.
+`, e.CIDR, CFGPublicURL, hex.EncodeToString(token)))
+	if err != nil {
+		o.db.DeleteOptOut(strconv.Itoa(int(e.ID)))
+		return nil, err
+	}
+	return e, nil
+}
+
+func verifyHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify marks the request the token was mailed for as confirmed by its
+// contact. Each token only works once.
+func (o *OptOuts) Verify(token string) (*OptOut, error) {
+	e, err := o.db.GetOptOutByVerifyHash(verifyHash(token))
+	if err != nil {
+		return nil, errBadVerifyToken
+	}
+	e.Verified = true
+	e.VerifyHash = ""
+	return &e, o.db.SaveOptOut(&e)
+}
+
+// Approve enforces a verified request and purges everything we already
+// stored about hosts inside it.
+func (o *OptOuts) Approve(id string) (*OptOut, error) {
+	e, err := o.db.GetOptOut(id)
+	if err != nil {
+		return nil, err
+	}
+	if !e.Verified {
+		return nil, errNotVerified
+	}
+	return &e, o.approve(&e)
+}
+
+func (o *OptOuts) approve(e *OptOut) error {
+	ipnet, err := parseCIDR(e.CIDR)
+	if err != nil {
+		return err
+	}
+	e.Status = OptOutApproved
+	if err := o.db.SaveOptOut(e); err != nil {
+		return err
+	}
+	if err := o.reload(); err != nil {
+		return err
+	}
+
+	ips, err := o.db.GetHostIPs()
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if ipnet.Contains(net.ParseIP(ip)) {
+			if err := o.db.PurgeHost(ip); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *OptOuts) Delete(id string) error {
+	if err := o.db.DeleteOptOut(id); err != nil {
+		return err
+	}
+	return o.reload()
+}
+
+// sourceLimiter allows each source max requests per window, it is what
+// keeps the public form from being used to send mail or fill the audit log.
+type sourceLimiter struct {
+	mu sync.Mutex
+	max int
+	window time.Duration
+	seen map[string][]time.Time
+}
+
+func newSourceLimiter(max int, window time.Duration) *sourceLimiter {
+	return &sourceLimiter{max: max, window: window, seen: make(map[string][]time.Time)}
+}
+
+func (l *sourceLimiter) Allow(source string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for s, times := range l.seen {
+		for len(times) > 0 && now.Sub(times[0]) >= l.window {
+			times = times[1:]
+		}
+		if len(times) == 0 {
+			delete(l.seen, s)
+		} else {
+			l.seen[s] = times
+		}
+	}
+	if len(l.seen[source]) >= l.max {
+		return false
+	}
+	l.seen[source] = append(l.seen[source], now)
+	return true
+}
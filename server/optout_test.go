@@ -0,0 +1,165 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func requestOptOut(t *testing.T, o *OptOuts, msgs chan string, cidr, contact string) (*OptOut, string, error) {
+	req, err := CheckRequest(cidr, contact, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := o.Request(req)
+	if err != nil {
+		return nil, "", err
+	}
+	m := regexp.MustCompile(`token=([0-9a-f]+)`).FindStringSubmatch(<-msgs)
+	if m == nil {
+		t.Fatal("no verification link in message")
+	}
+	return e, m[1], nil
+}
+
+func TestOptOutRequest(t *testing.T) {
+	db := newTestDB(t)
+	var msgs chan string
+	CFGSMTPAddr, msgs = smtpStub(t)
+	optOuts, err := LoadOptOuts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestHost(t, db, "192.0.2.10", "a", 5900)
+
+	req, err := CheckRequest("192.0.2.0/24", "Owner <owner@example.com>", "ours")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := optOuts.Request(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if optOuts.Contains("192.0.2.10") {
+		t.Error("pending request is enforced")
+	}
+	if n, _ := db.CountHosts(""); n != 1 {
+		t.Error("pending request purged hosts")
+	}
+	id := strconv.Itoa(int(e.ID))
+	if _, err := optOuts.Approve(id); err != errNotVerified {
+		t.Errorf("approving unverified request returned %v", err)
+	}
+
+	m := regexp.MustCompile(`token=([0-9a-f]+)`).FindStringSubmatch(<-msgs)
+	if m == nil {
+		t.Fatal("no verification link in message")
+	}
+	if _, err := optOuts.Verify(m[1] + "0"); err != errBadVerifyToken {
+		t.Errorf("wrong token returned %v", err)
+	}
+	if _, err := optOuts.Verify(m[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := optOuts.Verify(m[1]); err != errBadVerifyToken {
+		t.Errorf("reusing token returned %v", err)
+	}
+	if optOuts.Contains("192.0.2.10") {
+		t.Error("verified but unapproved request is enforced")
+	}
+
+	if _, err := optOuts.Approve(id); err != nil {
+		t.Fatal(err)
+	}
+	if !optOuts.Contains("192.0.2.10") {
+		t.Error("approved request is not enforced")
+	}
+	if n, _ := db.CountHosts(""); n != 0 {
+		t.Error("approved request did not purge hosts")
+	}
+}
+
+func TestOptOutConflicts(t *testing.T) {
+	db := newTestDB(t)
+	var msgs chan string
+	CFGSMTPAddr, msgs = smtpStub(t)
+	optOuts, err := LoadOptOuts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unconfirmed request is replaced by the next one
+	_, first, err := requestOptOut(t, optOuts, msgs, "192.0.2.0/24", "someone@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, second, err := requestOptOut(t, optOuts, msgs, "192.0.2.0/24", "owner@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := optOuts.Verify(first); err != errBadVerifyToken {
+		t.Errorf("replaced token returned %v", err)
+	}
+	if v, err := optOuts.Verify(second); err != nil || v.ID != e.ID || v.Contact != "owner@example.com" {
+		t.Fatalf("Verify = %v, %v", v, err)
+	}
+	// a confirmed one holds the network until an admin decides
+	if _, _, err := requestOptOut(t, optOuts, msgs, "192.0.2.0/24", "someone@example.com"); err != errOptOutExists {
+		t.Errorf("request for a confirmed network returned %v", err)
+	}
+
+	// admins can add networks someone already asked for
+	if _, _, err := requestOptOut(t, optOuts, msgs, "198.51.100.0/24", "someone@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	added, err := optOuts.Add("198.51.100.0/24", "admin@example.com", "call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Status != OptOutApproved || !optOuts.Contains("198.51.100.1") {
+		t.Errorf("admin opt out is %s", added.Status)
+	}
+	if _, _, err := requestOptOut(t, optOuts, msgs, "198.51.100.0/24", "someone@example.com"); err != errOptOutExists {
+		t.Errorf("request for an opted out network returned %v", err)
+	}
+	if list, _ := db.GetOptOuts(); len(list) != 2 {
+		t.Errorf("%d opt outs, want 2", len(list))
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	for _, c := range []struct {
+		cidr, contact, reason string
+	}{
+		{"10.0.0.0/8", "owner@example.com", ""},
+		{"192.0.2.0/24", "not an address", ""},
+		{"192.0.2.0/24", strings.Repeat("a", 250) + "@example.com", ""},
+		{"192.0.2.0/24", "owner@example.com", strings.Repeat("a", maxOptOutReason + 1)},
+		{strings.Repeat("1", 100), "owner@example.com", ""},
+	} {
+		if _, err := CheckRequest(c.cidr, c.contact, c.reason); err == nil {
+			t.Errorf("accepted %.20q %.20q %.20q", c.cidr, c.contact, c.reason)
+		}
+	}
+}
+
+func TestSourceLimiter(t *testing.T) {
+	l := newSourceLimiter(2, time.Hour)
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if got := l.Allow("a", now); got != want {
+			t.Errorf("request %d allowed: %v", i, got)
+		}
+	}
+	if !l.Allow("b", now) {
+		t.Error("other source limited")
+	}
+	if !l.Allow("a", now.Add(time.Hour)) {
+		t.Error("still limited after the window")
+	}
+	if len(l.seen) != 1 {
+		t.Errorf("%d sources remembered after the window", len(l.seen))
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var errBadToken = errors.New("Invalid or expired token")
+
+// ProxyToken authorizes one user to open one proxied VNC session, it can
+// only be used once.
+type ProxyToken struct {
+	ID string
+	User string
+	Engagement string
+	Target string
+	ViewOnly bool
+	Expires time.Time
+}
+
+// ProxySession is the audit record of a proxied VNC session.
+type ProxySession struct {
+	ID uint `gorm:"primaryKey"`
+	User string
+	Target string
+	ViewOnly bool
+	StartedAt time.Time
+	EndedAt time.Time
+	BytesIn int64
+	BytesOut int64
+}
+
+type VNCProxy struct {
+	key []byte
+	db *DB
+	scope *Scope
+	mu sync.Mutex
+	// used holds the IDs of tokens already used until they expire
+	used map[string]time.Time
+}
+
+func NewVNCProxy(keyFile string, db *DB, scope *Scope) (*VNCProxy, error) {
+	key, err := loadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &VNCProxy{key: key, db: db, scope: scope, used: make(map[string]time.Time)}, nil
+}
+
+func (p *VNCProxy) mac(payload string) string {
+	m := hmac.New(sha256.New, p.key)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func (p *VNCProxy) Issue(user, engagement, target string, viewOnly bool) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(ProxyToken{
+		ID: base64.RawURLEncoding.EncodeToString(id),
+		User: user,
+		Engagement: engagement,
+		Target: target,
+		ViewOnly: viewOnly,
+		Expires: time.Now().Add(CFGProxyTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + p.mac(payload), nil
+}
+
+func (p *VNCProxy) Verify(token string) (*ProxyToken, error) {
+	payload, mac, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(p.mac(payload))) {
+		return nil, errBadToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errBadToken
+	}
+	var t ProxyToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, errBadToken
+	}
+	now := time.Now()
+	if now.After(t.Expires) {
+		return nil, errBadToken
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, expires := range p.used {
+		if now.After(expires) {
+			delete(p.used, id)
+		}
+	}
+	if _, ok := p.used[t.ID]; ok {
+		return nil, errBadToken
+	}
+	p.used[t.ID] = t.Expires
+	return &t, nil
+}
+
+// allowed checks that a running session may go on, the user may have been
+// deleted or the host opted out since it started.
+func (p *VNCProxy) allowed(t *ProxyToken) error {
+	if _, ok := CFGAdminAccount[t.User]; !ok {
+		if _, err := p.db.GetUser(t.User); err != nil {
+			return fmt.Errorf("user %s no longer exists", t.User)
+		}
+	}
+	host, _, err := net.SplitHostPort(t.Target)
+	if err != nil {
+		return err
+	}
+	_, err = p.scope.Check(host)
+	return err
+}
+
+// ServeWS relays an already verified session between the websocket and the
+// VNC server, recording it in the database.
+func (p *VNCProxy) ServeWS(ws *websocket.Conn, t *ProxyToken) {
+	ws.PayloadType = websocket.BinaryFrame
+	defer ws.Close()
+
+	target, err := net.DialTimeout("tcp", t.Target, CFGProxyDialTimeout)
+	if err != nil {
+		log.Printf("Proxy %s -> %s: %s", t.User, t.Target, err.Error())
+		return
+	}
+	defer target.Close()
+
+	session := ProxySession{
+		User: t.User,
+		Target: t.Target,
+		ViewOnly: t.ViewOnly,
+		StartedAt: time.Now(),
+	}
+	if err := p.db.AddProxySession(&session); err != nil {
+		log.Printf("Proxy %s -> %s: %s", t.User, t.Target, err.Error())
+		return
+	}
+	log.Printf("Proxy %s -> %s started (view only: %t)", t.User, t.Target, t.ViewOnly)
+
+	// sessions end after CFGProxySessionMax, or as soon as they are no
+	// longer allowed
+	deadline := session.StartedAt.Add(CFGProxySessionMax)
+	ws.SetDeadline(deadline)
+	target.SetDeadline(deadline)
+	reason := "closed"
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		ticker := time.NewTicker(CFGProxyCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if err := p.allowed(t); err != nil {
+				reason = err.Error()
+				ws.Close()
+				target.Close()
+				return
+			}
+		}
+	}()
+
+	var in, out int64
+	done := make(chan struct{}, 2)
+	version := make(chan int, 1)
+	security := make(chan byte, 1)
+
+	go func() {
+		var err error
+		if t.ViewOnly {
+			err = relayServer(ws, target, &in, version, security)
+		} else {
+			err = relay(ws, target, &in)
+		}
+		if !closed(err) {
+			log.Printf("Proxy %s -> %s: %s", t.User, t.Target, err.Error())
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		var err error
+		if t.ViewOnly {
+			err = relayViewOnly(target, ws, &out, version, security)
+		} else {
+			err = relay(target, ws, &out)
+		}
+		if !closed(err) {
+			log.Printf("Proxy %s -> %s: %s", t.User, t.Target, err.Error())
+		}
+		done <- struct{}{}
+	}()
+
+	<-done
+	ws.Close()
+	target.Close()
+	<-done
+	close(stop)
+	<-watched
+
+	session.EndedAt = time.Now()
+	if !session.EndedAt.Before(deadline) {
+		reason = "session limit reached"
+	}
+	session.BytesIn = atomic.LoadInt64(&in)
+	session.BytesOut = atomic.LoadInt64(&out)
+	if err := p.db.SaveProxySession(&session); err != nil {
+		log.Printf("Proxy %s -> %s: %s", t.User, t.Target, err.Error())
+	}
+	p.db.Audit(AuditEntry{
+		Engagement: t.Engagement,
+		Actor: t.User,
+		Action: "vnc session",
+		Target: t.Target,
+		Result: fmt.Sprintf("session %d, view only: %t, %d bytes in, %d bytes out: %s",
+			session.ID, t.ViewOnly, session.BytesIn, session.BytesOut, reason),
+	})
+	log.Printf("Proxy %s -> %s ended (%s), %d bytes in, %d bytes out",
+		t.User, t.Target, reason, session.BytesIn, session.BytesOut)
+}
+
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func relay(dst io.Writer, src io.Reader, n *int64) error {
+	_, err := io.Copy(countWriter{dst, n}, src)
+	return err
+}
+
+// closed reports whether err just means one side hung up or the session
+// was ended.
+func closed(err error) bool {
+	return err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// relayServer forwards the server side of a view only session, telling
+// relayViewOnly which security type an RFB 3.3 server picked.
+func relayServer(dst io.Writer, src io.Reader, n *int64, version chan int, security chan byte) error {
+	defer close(security)
+	w := countWriter{dst, n}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(src, buf); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	if <-version < 7 {
+		buf = buf[:4]
+		if _, err := io.ReadFull(src, buf); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		security <- byte(binary.BigEndian.Uint32(buf))
+	}
+	return relay(dst, src, n)
+}
+
+// relayViewOnly forwards the client side of a session, dropping every key,
+// pointer and clipboard event after the handshake.
+func relayViewOnly(dst io.Writer, src io.Reader, n *int64, version chan int, security chan byte) error {
+	w := countWriter{dst, n}
+	forward := func(l int) ([]byte, error) {
+		buf := make([]byte, l)
+		if _, err := io.ReadFull(src, buf); err != nil {
+			return nil, err
+		}
+		_, err := w.Write(buf)
+		return buf, err
+	}
+	discard := func(l int64) error {
+		_, err := io.CopyN(io.Discard, src, l)
+		return err
+	}
+
+	buf, err := forward(12)
+	if err != nil {
+		close(version)
+		return err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(buf), "RFB %03d.%03d\n", &major, &minor); err != nil {
+		close(version)
+		return errors.New("Not an RFB client")
+	}
+	version <- minor
+
+	var sec byte
+	if minor < 7 {
+		var ok bool
+		if sec, ok = <-security; !ok {
+			return errors.New("Server closed during handshake")
+		}
+	} else {
+		buf, err = forward(1)
+		if err != nil {
+			return err
+		}
+		sec = buf[0]
+	}
+	switch sec {
+	case rfbSecNone:
+	case rfbSecVNC:
+		if _, err := forward(16); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Security type %d not supported in view only mode", sec)
+	}
+
+	// ClientInit, always ask to share the desktop
+	if err := discard(1); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{1}); err != nil {
+		return err
+	}
+
+	msg := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(src, msg); err != nil {
+			return err
+		}
+		switch msg[0] {
+		case 4: // KeyEvent
+			if err := discard(7); err != nil {
+				return err
+			}
+			continue
+		case 5: // PointerEvent
+			if err := discard(5); err != nil {
+				return err
+			}
+			continue
+		case 6: // ClientCutText
+			buf = make([]byte, 7)
+			if _, err := io.ReadFull(src, buf); err != nil {
+				return err
+			}
+			if err := discard(int64(binary.BigEndian.Uint32(buf[3:]))); err != nil {
+				return err
+			}
+			continue
+		case 251: // SetDesktopSize would resize the remote desktop
+			buf = make([]byte, 7)
+			if _, err := io.ReadFull(src, buf); err != nil {
+				return err
+			}
+			if err := discard(16 * int64(buf[5])); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+		switch msg[0] {
+		case 0: // SetPixelFormat
+			_, err = forward(19)
+		case 2: // SetEncodings
+			buf, err = forward(3)
+			if err == nil {
+				_, err = forward(4 * int(binary.BigEndian.Uint16(buf[1:])))
+			}
+		case 3: // FramebufferUpdateRequest
+			_, err = forward(9)
+		case 150: // EnableContinuousUpdates
+			_, err = forward(9)
+		case 248: // ClientFence
+			buf, err = forward(8)
+			if err == nil {
+				_, err = forward(int(buf[7]))
+			}
+		default:
+			return fmt.Errorf("Unexpected client message %d", msg[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func newTestProxy(t *testing.T) (*VNCProxy, *DB) {
+	db := newTestDB(t)
+	scope, err := LoadScope(writeScope(t, "127.0.0.1 a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewVNCProxy(filepath.Join(t.TempDir(), "proxy.key"), db, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, db
+}
+
+func TestProxyToken(t *testing.T) {
+	p, _ := newTestProxy(t)
+	token, err := p.Issue("bob", "a", "127.0.0.1:5900", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Verify(token + "x"); err != errBadToken {
+		t.Errorf("tampered token: %v", err)
+	}
+	if pt, err := p.Verify(token); err != nil || pt.User != "bob" {
+		t.Fatalf("Verify = %v, %v", pt, err)
+	}
+	if _, err := p.Verify(token); err != errBadToken {
+		t.Errorf("token used twice: %v", err)
+	}
+}
+
+// proxySession runs a session through p to a VNC server that never says
+// anything and returns how long it took to end.
+func proxySession(t *testing.T, p *VNCProxy) time.Duration {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	token, err := p.Issue("bob", "a", l.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := p.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		p.ServeWS(ws, pt)
+		close(served)
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	ws, err := websocket.Dial("ws" + strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ws.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("session did not end: %v", err)
+	}
+	d := time.Since(start)
+	<-served
+	return d
+}
+
+func TestProxySessionLimits(t *testing.T) {
+	defer func(max, interval time.Duration) {
+		CFGProxySessionMax, CFGProxyCheckInterval = max, interval
+	}(CFGProxySessionMax, CFGProxyCheckInterval)
+
+	p, db := newTestProxy(t)
+	if err := db.SaveUser(&User{Name: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	CFGProxySessionMax, CFGProxyCheckInterval = 200 * time.Millisecond, time.Hour
+	if d := proxySession(t, p); d < CFGProxySessionMax {
+		t.Errorf("session ended after %s", d)
+	}
+
+	CFGProxySessionMax, CFGProxyCheckInterval = time.Hour, 50 * time.Millisecond
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		db.DeleteUser("bob")
+	}()
+	proxySession(t, p)
+
+	entries, err := db.GetAudit("a")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("%d audit entries, %v", len(entries), err)
+	}
+	for i, reason := range []string{"session limit reached", "user bob no longer exists"} {
+		if !strings.HasSuffix(entries[i].Result, reason) {
+			t.Errorf("session %d ended with %q, want %q", i, entries[i].Result, reason)
+		}
+	}
+}
+
+func TestRelayViewOnly(t *testing.T) {
+	handshake := []byte("RFB 003.008\n\x01\x00")
+	key := []byte{4, 1, 0, 0, 0, 0, 0, 0x41}
+	pointer := []byte{5, 1, 0, 10, 0, 10}
+	cut := []byte{6, 0, 0, 0, 0, 0, 0, 2, 'h', 'i'}
+	resize := append([]byte{251, 0, 4, 0, 3, 0, 1, 0}, make([]byte, 16)...)
+	continuous := []byte{150, 1, 0, 0, 0, 0, 4, 0, 3, 0}
+	fence := []byte{248, 0, 0, 0, 0x80, 0, 0, 1, 2, 'a', 'b'}
+	update := []byte{3, 1, 0, 0, 0, 0, 4, 0, 3, 0}
+
+	var in bytes.Buffer
+	for _, m := range [][]byte{handshake, key, continuous, pointer, fence, cut, resize, update} {
+		in.Write(m)
+	}
+	var out bytes.Buffer
+	var n int64
+	err := relayViewOnly(&out, &in, &n, make(chan int, 1), make(chan byte))
+	if err != io.EOF {
+		t.Fatalf("relayViewOnly returned %v, want EOF at the end of input", err)
+	}
+
+	var want bytes.Buffer
+	want.WriteString("RFB 003.008\n\x01\x01") // ClientInit forced to shared
+	for _, m := range [][]byte{continuous, fence, update} {
+		want.Write(m)
+	}
+	if !bytes.Equal(out.Bytes(), want.Bytes()) {
+		t.Errorf("forwarded %v, want %v", out.Bytes(), want.Bytes())
+	}
+	if n != int64(want.Len()) {
+		t.Errorf("counted %d bytes, want %d", n, want.Len())
+	}
+}
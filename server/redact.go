@@ -0,0 +1,185 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var emailRegex = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+var cardRegex = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+var credRegex = regexp.MustCompile(`(?i)\b(pass(?:word|wd|phrase)?|pwd|pin|secret|token|api[_-]?key|auth)\b(\s*[:=]\s*|\s+)\S+`)
+
+const redacted = "[REDACTED]"
+
+// ScrubText removes anything in OCR output that looks like a credential, an
+// email address or a card number.
+func ScrubText(text string) string {
+	text = credRegex.ReplaceAllString(text, "$1$2" + redacted)
+	text = emailRegex.ReplaceAllString(text, redacted)
+	return cardRegex.ReplaceAllStringFunc(text, func(s string) string {
+		if luhn(s) {
+			return redacted
+		}
+		return s
+	})
+}
+
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if n % 2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum % 10 == 0
+}
+
+// RedactScreenshot blurs the raw screenshot in from and writes it to to with
+// permissions only the server can read. The raw file is always removed.
+func RedactScreenshot(from, to string) error {
+	defer os.Remove(from)
+
+	f, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	img, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(to, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return jpeg.Encode(out, blur(img, CFGBlurRadius), nil)
+}
+
+// blur is a two pass box blur.
+func blur(src image.Image, radius int) *image.RGBA {
+	b := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+	if radius <= 0 {
+		return img
+	}
+	tmp := image.NewRGBA(img.Bounds())
+	boxBlur(tmp.Pix, img.Pix, img.Rect.Dx(), img.Rect.Dy(), 4, img.Stride, radius)
+	boxBlur(img.Pix, tmp.Pix, img.Rect.Dy(), img.Rect.Dx(), img.Stride, 4, radius)
+	return img
+}
+
+// boxBlur averages each of n lines of length l, where step is the distance
+// between pixels on a line and stride the distance between lines.
+func boxBlur(dst, src []byte, l, n, step, stride, radius int) {
+	for line := 0; line < n; line++ {
+		base := line * stride
+		for c := 0; c < 4; c++ {
+			sum, count := 0, 0
+			for i := 0; i < radius && i < l; i++ {
+				sum += int(src[base + i * step + c])
+				count++
+			}
+			for i := 0; i < l; i++ {
+				if i + radius < l {
+					sum += int(src[base + (i + radius) * step + c])
+					count++
+				}
+				if i - radius - 1 >= 0 {
+					sum -= int(src[base + (i - radius - 1) * step + c])
+					count--
+				}
+				dst[base + i * step + c] = byte(sum / count)
+			}
+		}
+	}
+}
+
+// redactedMarker is created once every screenshot has been through
+// RedactScreenshot, older versions served them unblurred.
+const redactedMarker = "./screenshots/.redacted"
+
+// RedactExisting blurs screenshots left from before redaction, keeping their
+// times so they still expire when they would have.
+func RedactExisting() error {
+	if _, err := os.Stat(redactedMarker); err == nil {
+		return nil
+	}
+	files, err := filepath.Glob("./screenshots/*.jpeg")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if err := RedactScreenshot(file, file + ".tmp"); err != nil {
+			// can't be blurred, so it can't be kept either
+			log.Printf("Removing %s: %s", file, err)
+			os.Remove(file + ".tmp")
+			continue
+		}
+		if err := os.Rename(file + ".tmp", file); err != nil {
+			return err
+		}
+		if err := os.Chtimes(file, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	log.Printf("Redacted %d existing screenshots", len(files))
+	return os.WriteFile(redactedMarker, nil, 0600)
+}
+
+// PurgeExpired deletes screenshots and OCR text older than CFGRetention,
+// including raw screenshots left behind when taking one failed halfway.
+func PurgeExpired(db *DB) {
+	before := time.Now().Add(-CFGRetention)
+	files, err := filepath.Glob("./screenshots/*.jpeg")
+	if err != nil {
+		log.Println(err)
+	}
+	raw, err := filepath.Glob(filepath.Join(CFGRawScreenshotDir, "*.jpeg"))
+	if err != nil {
+		log.Println(err)
+	}
+	files = append(files, raw...)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.ModTime().After(before) {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			log.Println(err)
+		} else {
+			log.Printf("Purged %s", file)
+		}
+	}
+	if err := db.PurgeText(before); err != nil {
+		log.Println(err)
+	}
+}
+
+func RetentionLoop(db *DB) {
+	for {
+		PurgeExpired(db)
+		time.Sleep(CFGRetentionInterval)
+	}
+}
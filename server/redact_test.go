@@ -0,0 +1,100 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLuhn(t *testing.T) {
+	for s, want := range map[string]bool{
+		"4111 1111 1111 1111": true,
+		"4111-1111-1111-1112": false,
+		"79927398713": false, // valid checksum but too short for a card
+		"5500000000000004": true,
+	} {
+		if got := luhn(s); got != want {
+			t.Errorf("luhn(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestScrubText(t *testing.T) {
+	for in, want := range map[string]string{
+		"password: hunter2": "password: " + redacted,
+		"PIN 1234 please": "PIN " + redacted + " please",
+		"mail bob@example.com now": "mail " + redacted + " now",
+		"card 4111 1111 1111 1111 ok": "card " + redacted + " ok",
+		"order 1234 5678 9012 3456": "order 1234 5678 9012 3456",
+		"nothing to see here": "nothing to see here",
+	} {
+		if got := ScrubText(in); got != want {
+			t.Errorf("ScrubText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// chdirTemp runs the test in an empty directory, for code that uses paths
+// relative to the working directory.
+func chdirTemp(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestRedactExisting(t *testing.T) {
+	chdirTemp(t)
+	os.Mkdir("screenshots", 0700)
+	// a sharp edge the blur has to soften
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for x := 16; x < 32; x++ {
+		for y := 0; y < 32; y++ {
+			img.SetGray(x, y, color.Gray{255})
+		}
+	}
+	f, _ := os.Create("screenshots/10.0.0.1_5900.jpeg")
+	jpeg.Encode(f, img, &jpeg.Options{Quality: 100})
+	f.Close()
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes("screenshots/10.0.0.1_5900.jpeg", old, old)
+	os.WriteFile("screenshots/10.0.0.2_5900.jpeg", []byte("not a jpeg"), 0600)
+
+	if err := RedactExisting(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("screenshots/10.0.0.2_5900.jpeg"); err == nil {
+		t.Error("a screenshot that can't be blurred was kept")
+	}
+	info, err := os.Stat("screenshots/10.0.0.1_5900.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Errorf("modification time changed to %s", info.ModTime())
+	}
+	f, _ = os.Open("screenshots/10.0.0.1_5900.jpeg")
+	blurred, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := blurred.At(15, 16).RGBA(); r < 0x1000 {
+		t.Error("screenshot was not blurred")
+	}
+
+	// only done once
+	mtime := info.ModTime()
+	os.Chtimes("screenshots/10.0.0.1_5900.jpeg", mtime, mtime.Add(time.Minute))
+	RedactExisting()
+	if info, _ := os.Stat("screenshots/10.0.0.1_5900.jpeg"); !info.ModTime().Equal(mtime.Add(time.Minute)) {
+		t.Error("screenshots redacted again")
+	}
+}
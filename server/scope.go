@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+var errOutOfScope = errors.New("Target out of scope")
+
+type ScopeEntry struct {
+	Net *net.IPNet
+	Engagement string
+}
+
+type Scope struct {
+	Entries []ScopeEntry
+	OptOuts *OptOuts
+}
+
+// LoadScope reads the authorized scope, one CIDR (or bare IP) per line,
+// optionally followed by the name of the engagement it belongs to.
+// Everything after a '#' is a comment.
+func LoadScope(file string) (*Scope, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scope := &Scope{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: too many fields", file, n)
+		}
+		ipnet, err := parseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		engagement := CFGDefaultEngagement
+		if len(fields) > 1 {
+			engagement = fields[1]
+		}
+		// otherwise hosts get scanned twice and which entry (and so which
+		// engagement and credentials) a host gets depends on line order
+		for _, e := range scope.Entries {
+			if e.Net.Contains(ipnet.IP) || ipnet.Contains(e.Net.IP) {
+				return nil, fmt.Errorf("%s:%d: %s overlaps %s of engagement %s",
+					file, n, ipnet, e.Net, e.Engagement)
+			}
+		}
+		scope.Entries = append(scope.Entries, ScopeEntry{
+			Net: ipnet,
+			Engagement: engagement,
+		})
+	}
+	return scope, scanner.Err()
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+func (s *Scope) Lookup(ip string) *ScopeEntry {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	for i := range s.Entries {
+		if s.Entries[i].Net.Contains(parsed) {
+			return &s.Entries[i]
+		}
+	}
+	return nil
+}
+
+// EngagementOf returns the engagement ip belongs to, or "" if it is out of
+// scope.
+func (s *Scope) EngagementOf(ip string) string {
+	if e := s.Lookup(ip); e != nil {
+		return e.Engagement
+	}
+	return ""
+}
+
+func (s *Scope) Contains(ip string) bool {
+	return s.Lookup(ip) != nil
+}
+
+// Check returns the scope entry for ip if we may touch it at all.
+func (s *Scope) Check(ip string) (*ScopeEntry, error) {
+	entry := s.Lookup(ip)
+	if entry == nil {
+		return nil, errOutOfScope
+	}
+	if s.OptOuts != nil && s.OptOuts.Contains(ip) {
+		return nil, errOptedOut
+	}
+	return entry, nil
+}
+
+type Range struct {
+	CIDR string
+	Engagement string
+}
+
+// Ranges splits the scope into chunks no larger than CFGRangePrefix so the
+// work can be spread across clients, leaving out chunks that are entirely
+// opted out.
+func (s *Scope) Ranges() []Range {
+	var ranges []Range
+	for _, e := range s.Entries {
+		for _, cidr := range splitNet(e.Net, CFGRangePrefix) {
+			if s.OptOuts != nil && s.OptOuts.Covers(cidr) {
+				continue
+			}
+			ranges = append(ranges, Range{cidr, e.Engagement})
+		}
+	}
+	return ranges
+}
+
+func splitNet(n *net.IPNet, prefix int) []string {
+	ones, bits := n.Mask.Size()
+	ip4 := n.IP.To4()
+	if bits != 32 || ip4 == nil || ones >= prefix {
+		return []string{n.String()}
+	}
+	base := binary.BigEndian.Uint32(ip4)
+	step := uint32(1) << (32 - prefix)
+	res := make([]string, 0, 1 << (prefix - ones))
+	for i := 0; i < 1 << (prefix - ones); i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base + uint32(i) * step)
+		res = append(res, fmt.Sprintf("%s/%d", ip, prefix))
+	}
+	return res
+}
+
+// Entry returns the scope entry that exactly matches cidr.
+func (s *Scope) Entry(cidr string) *ScopeEntry {
+	ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return nil
+	}
+	for i := range s.Entries {
+		if s.Entries[i].Net.String() == ipnet.String() {
+			return &s.Entries[i]
+		}
+	}
+	return nil
+}
+
+func (s *Scope) HasEngagement(engagement string) bool {
+	for _, e := range s.Entries {
+		if e.Engagement == engagement {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeScope(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "scope.txt")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadScope(t *testing.T) {
+	scope, err := LoadScope(writeScope(t, "# comment\n10.0.0.0/24 a\n10.0.1.5 a # same engagement\n192.168.1.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scope.EngagementOf("10.0.0.9"); got != "a" {
+		t.Errorf("EngagementOf(10.0.0.9) = %q, want a", got)
+	}
+	if got := scope.EngagementOf("192.168.1.1"); got != CFGDefaultEngagement {
+		t.Errorf("EngagementOf(192.168.1.1) = %q, want %s", got, CFGDefaultEngagement)
+	}
+	if got := scope.EngagementOf("10.0.1.5"); got != "a" {
+		t.Errorf("EngagementOf(10.0.1.5) = %q, want a", got)
+	}
+	if scope.Contains("10.0.1.1") {
+		t.Error("10.0.1.1 should be out of scope")
+	}
+}
+
+func TestLoadScopeOverlap(t *testing.T) {
+	for _, content := range []string{
+		"10.0.0.0/16 a\n10.0.5.0/24 b\n",
+		"10.0.5.0/24 b\n10.0.0.0/16 a\n",
+		"10.0.0.0/8 a\n10.1.2.3 b\n",
+		"10.0.0.0/24 a\n10.0.0.5 a\n",
+		"10.0.0.0/24 a\n10.0.0.0/24 a\n",
+	} {
+		_, err := LoadScope(writeScope(t, content))
+		if err == nil || !strings.Contains(err.Error(), "overlaps") {
+			t.Errorf("%q: got %v, want an overlap error", content, err)
+		}
+	}
+}
+
+func TestSplitNet(t *testing.T) {
+	n, _ := parseCIDR("10.0.0.0/14")
+	want := []string{"10.0.0.0/16", "10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16"}
+	if got := splitNet(n, 16); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitNet(10.0.0.0/14, 16) = %v, want %v", got, want)
+	}
+	n, _ = parseCIDR("10.0.0.0/24")
+	if got := splitNet(n, 16); !reflect.DeepEqual(got, []string{"10.0.0.0/24"}) {
+		t.Errorf("splitNet(10.0.0.0/24, 16) = %v", got)
+	}
+}
@@ -1,35 +1,53 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
+const rfbSecNone = 1
+const rfbSecVNC = 2
+
+var errAuthRequired = errors.New("Auth required")
+
 type VNCInfo struct {
 	Username string
-	Password string
 	ClientName string
 	Width int
 	Height int
+	AuthRequired bool
+}
+
+func screenshotFile(ip, port string) string {
+	return fmt.Sprintf("./screenshots/%s_%s.jpeg", ip, port)
+}
+
+// rawScreenshotFile is where vncscreenshot writes before redaction, it is
+// never served.
+func rawScreenshotFile(ip, port string) string {
+	return fmt.Sprintf("%s/%s_%s.jpeg", CFGRawScreenshotDir, ip, port)
 }
 
 func doScreenshot(ip, port, username, password string) (*VNCInfo, error) {
-	file := fmt.Sprintf("./screenshots/%s_%s.jpeg", ip, port)
-	cmd := exec.Command(CFGVNCScreenshotBin, CFGVNCTimeout, ip, port, file, username, password)
+	file := rawScreenshotFile(ip, port)
+	cmd := exec.Command(CFGVNCScreenshotBin, CFGVNCTimeout, ip, port, file)
+	// not as arguments, anyone on the box can read those
+	cmd.Stdin = strings.NewReader(username + "\n" + password + "\n")
 	out, err := cmd.Output()
 	if err != nil {
 		return nil, errors.New(strings.TrimSpace(string(out)))
 	}
 	split := strings.Split(string(out), "\n")
 
-	if split[0] == "0" {
-		username = ""
-		password = ""
-	} else if split[0] == "1" {
+	if split[0] == "0" || split[0] == "1" {
 		username = ""
 	}
 
@@ -44,51 +62,147 @@ func doScreenshot(ip, port, username, password string) (*VNCInfo, error) {
 
 	return &VNCInfo{
 		Username: username,
-		Password: password,
 		ClientName: split[3],
 		Width: w,
 		Height: h,
 	}, nil
 }
 
-func VNCScreenshot(ip, port, username, password string) (*VNCInfo, error) {
-	if password != "" {
-		return doScreenshot(ip, port, username, password)
+// vncAuthTypes performs just enough of the RFB handshake to learn which
+// security types the server offers, then hangs up without authenticating.
+func vncAuthTypes(ip, port string) ([]byte, error) {
+	timeout, err := strconv.Atoi(CFGVNCTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, port), time.Duration(timeout) * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return nil, err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version), "RFB %03d.%03d\n", &major, &minor); err != nil {
+		return nil, errors.New("Not a VNC server")
+	}
+	if major > 3 || minor > 8 {
+		major, minor = 3, 8
 	}
 
-	for _, s := range CFGPasswords {
-		if username == "" {
-			username = "admin"
+	if minor < 7 {
+		if _, err := conn.Write([]byte("RFB 003.003\n")); err != nil {
+			return nil, err
 		}
-		info, err := doScreenshot(ip, port, username, s)
-		if err != nil && err.Error() != "Auth failed" {
+		var t uint32
+		if err := binary.Read(conn, binary.BigEndian, &t); err != nil {
 			return nil, err
-		} else if err != nil {
-			continue
 		}
-		return info, nil
+		if t == 0 {
+			return nil, errors.New("Server refused connection")
+		}
+		return []byte{byte(t)}, nil
+	}
+
+	if _, err := conn.Write([]byte(fmt.Sprintf("RFB %03d.%03d\n", major, minor))); err != nil {
+		return nil, err
 	}
-	return nil, errors.New("Could not screenshot VNC")
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(conn, n); err != nil {
+		return nil, err
+	}
+	if n[0] == 0 {
+		return nil, errors.New("Server refused connection")
+	}
+	types := make([]byte, n[0])
+	_, err = io.ReadFull(conn, types)
+	return types, err
+}
+
+func VNCScreenshot(ip, port string, cred *Credential) (*VNCInfo, error) {
+	if cred != nil {
+		return doScreenshot(ip, port, cred.Username, cred.Password)
+	}
+
+	// without credentials we only connect if the server would let us in
+	// without sending any, libvncclient picks the first type offered
+	types, err := vncAuthTypes(ip, port)
+	if err != nil {
+		return nil, err
+	}
+	if types[0] != rfbSecNone {
+		return nil, errAuthRequired
+	}
+	return doScreenshot(ip, port, "", "")
 }
 
-var vLimit = make(chan struct{}, CFGMaxVNCConns)
+var vLimit chan struct{}
 func vAcquire() { vLimit <- struct{}{} }
 func vRelease() { <-vLimit }
 
-func AddVNC(ip, port, username, password string, db *DB) error {
+// AddVNC screenshots ip:port on behalf of actor and stores the result.
+func AddVNC(ip, port, actor string, db *DB, scope *Scope, creds *CredStore) error {
+	entry, err := scope.Check(ip)
+	if err != nil {
+		log.Printf("%s:%s rejected: %s", ip, port, err.Error())
+		db.Audit(AuditEntry{
+			Engagement: scope.EngagementOf(ip),
+			Actor: actor,
+			Action: "screenshot",
+			Target: net.JoinHostPort(ip, port),
+			Result: err.Error(),
+		})
+		return err
+	}
+	var cred *Credential
+	if c, ok := creds.Get(entry); ok {
+		cred = c
+	}
+	tAcquire(entry.Engagement)
 	vAcquire()
-	info, err := VNCScreenshot(ip, port, username, password)
+	info, err := VNCScreenshot(ip, port, cred)
 	vRelease()
+	tRelease(entry.Engagement)
+	db.Audit(AuditEntry{
+		Engagement: entry.Engagement,
+		Actor: actor,
+		Action: "screenshot",
+		Target: net.JoinHostPort(ip, port),
+		Result: auditResult(err),
+	})
+	if err == errAuthRequired {
+		log.Printf("%s:%s %s", ip, port, err.Error())
+		if err := db.AddService(ip, port, entry.Engagement, "", &VNCInfo{AuthRequired: true}); err != nil {
+			log.Printf("%s:%s %s", ip, port, err.Error())
+			return err
+		}
+		return errAuthRequired
+	} else if err != nil {
+		log.Printf("%s:%s %s", ip, port, err.Error())
+		return err
+	}
+	raw := rawScreenshotFile(ip, port)
+	ocr := ScrubText(OCR(raw))
+	err = RedactScreenshot(raw, screenshotFile(ip, port))
 	if err != nil {
 		log.Printf("%s:%s %s", ip, port, err.Error())
 		return err
 	}
-	ocr := OCR(fmt.Sprintf("./screenshots/%s_%s.jpeg", ip, port))
-	err = db.AddService(ip, port, ocr, info)
+	err = db.AddService(ip, port, entry.Engagement, ocr, info)
 	if err != nil {
 		log.Printf("%s:%s %s", ip, port, err.Error())
 		return err
 	}
+	if cred == nil {
+		_port, _ := strconv.Atoi(port)
+		if err := OpenFinding(db, ip, uint16(_port)); err != nil {
+			log.Printf("%s:%s %s", ip, port, err.Error())
+		}
+	}
 	log.Printf("%s:%s Added VNC Successfully!", ip, port)
 	return nil
 }
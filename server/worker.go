@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile = "ca.key"
+)
+
+// Worker is an enrolled scanning client. It authenticates with its own
+// certificate, identified by its fingerprint.
+type Worker struct {
+	Name string `gorm:"primaryKey"`
+	Operator string
+	Engagement string
+	Fingerprint string `gorm:"uniqueIndex"`
+	Expires time.Time
+	Revoked bool
+	RevokedAt time.Time
+	CreatedAt time.Time
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func writePEM(file, typ string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), perm)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// InitCA creates the CA workers are enrolled with and a server certificate
+// for hosts signed by it.
+func InitCA(hosts []string) error {
+	if _, err := os.Stat(secretFile(caKeyFile)); err == nil {
+		return fmt.Errorf("%s already exists", secretFile(caKeyFile))
+	}
+	if err := os.MkdirAll(CFGSecretsDir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: "vncjew CA"},
+		NotBefore: time.Now(),
+		NotAfter: time.Now().Add(10 * 365 * 24 * time.Hour),
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(secretFile(caKeyFile), "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(secretFile(caCertFile), "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	tmpl = &x509.Certificate{
+		Subject: pkix.Name{CommonName: hosts[0]},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return issueCert(ca, key, tmpl, CFGTLSCert, CFGTLSKey)
+}
+
+func loadCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	keyPEM, err := readSecretFile(secretFile(caKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, nil, errors.New("invalid CA key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := loadCACert()
+	return ca, key, err
+}
+
+func loadCACert() (*x509.Certificate, error) {
+	certPEM, err := os.ReadFile(secretFile(caCertFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("invalid CA certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// issueCert signs tmpl with a fresh key and writes both out, only the
+// server's own certificate is made this way.
+func issueCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey,
+	tmpl *x509.Certificate, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := signCert(ca, caKey, tmpl, &key.PublicKey)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func signCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey,
+	tmpl *x509.Certificate, pub interface{}) ([]byte, error) {
+	var err error
+	tmpl.SerialNumber, err = newSerial()
+	if err != nil {
+		return nil, err
+	}
+	tmpl.NotBefore = time.Now()
+	tmpl.NotAfter = time.Now().Add(CFGCertLifetime)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	return x509.CreateCertificate(rand.Reader, tmpl, ca, pub, caKey)
+}
+
+var workerNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// EnrollWorker signs the certificate request a worker made, so its private
+// key never leaves it, and records who runs it. The certificate is written
+// to <name>.crt. Enrolling an existing name again replaces its certificate.
+func EnrollWorker(db *DB, name, operator, engagement, csrFile string) error {
+	if !workerNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid worker name %q", name)
+	}
+	csrPEM, err := os.ReadFile(csrFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return fmt.Errorf("%s is not a certificate request", csrFile)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return err
+	}
+
+	ca, caKey, err := loadCA()
+	if err != nil {
+		return err
+	}
+	// only the key is taken from the request, the rest is ours to decide
+	der, err := signCert(ca, caKey, &x509.Certificate{
+		Subject: pkix.Name{CommonName: name, OrganizationalUnit: []string{engagement}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, csr.PublicKey)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(name + ".crt", "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	return db.SaveWorker(&Worker{
+		Name: name,
+		Operator: operator,
+		Engagement: engagement,
+		Fingerprint: fingerprint(cert),
+		Expires: cert.NotAfter,
+	})
+}
+
+// RevokeWorker stops a worker's certificate from being accepted, connected
+// workers are dropped on their next ping.
+func RevokeWorker(db *DB, name, actor string) error {
+	worker, err := db.GetWorker(name)
+	if err == nil {
+		worker.Revoked = true
+		worker.RevokedAt = time.Now()
+		err = db.SaveWorker(&worker)
+	}
+	db.Audit(AuditEntry{
+		Engagement: worker.Engagement,
+		Actor: actor,
+		Action: "revoke worker",
+		Target: name,
+		Result: auditResult(err),
+	})
+	return err
+}
+
+// TLSConfig asks for, but does not require, a client certificate so that
+// browsers can still log in with a password.
+func TLSConfig() (*tls.Config, error) {
+	ca, err := loadCACert()
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs: pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// authWorker only lets through enrolled, unrevoked workers.
+func authWorker(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := c.Request.TLS
+		if state == nil || len(state.VerifiedChains) == 0 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		worker, err := db.GetWorkerByFingerprint(fingerprint(state.VerifiedChains[0][0]))
+		if err != nil || worker.Revoked {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Set("worker", &worker)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// enrollTestWorker enrolls a worker the way an operator would, from a
+// request made with a key that stays on the worker.
+func enrollTestWorker(t *testing.T, db *DB, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "ignored"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrFile := filepath.Join(t.TempDir(), "worker.csr")
+	os.WriteFile(csrFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), 0644)
+	if err := EnrollWorker(db, name, "alice", "a", csrFile); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := os.ReadFile(name + ".crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	cert, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestWorkerAuth(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	CFGSecretsDir = filepath.Join(dir, "secrets")
+	CFGTLSCert, CFGTLSKey = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	db := newTestDB(t)
+	if err := InitCA([]string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../w", "a/b", ".hidden", ""} {
+		if err := EnrollWorker(db, name, "alice", "a", "missing.csr"); err == nil {
+			t.Errorf("enrolled worker named %q", name)
+		}
+	}
+	cert := enrollTestWorker(t, db, "w1")
+
+	cfg, err := TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := tls.LoadX509KeyPair(CFGTLSCert, CFGTLSKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Certificates = []tls.Certificate{serverCert}
+	r := gin.New()
+	r.GET("/", authWorker(db), func(c *gin.Context) {
+		c.String(http.StatusOK, "%s", c.MustGet("worker").(*Worker).Operator)
+	})
+	srv := httptest.NewUnstartedServer(r)
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	ca, err := loadCACert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	get := func(certs ...tls.Certificate) int {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs},
+		}}
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := get(); code != http.StatusUnauthorized {
+		t.Errorf("without certificate got %d", code)
+	}
+	if code := get(cert); code != http.StatusOK {
+		t.Errorf("enrolled worker got %d", code)
+	}
+	if err := RevokeWorker(db, "w1", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(cert); code != http.StatusForbidden {
+		t.Errorf("revoked worker got %d", code)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"net/http"
+	"net"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/net/websocket"
@@ -19,46 +21,63 @@ type Client struct {
 	StartChan chan string
 	StopChan chan string
 	Ip string
+	Worker *Worker
+	// the range being scanned and the rate the worker last reported
+	Range *Range
+	Rate float64
+	OverRate bool
 }
 
 type WSServ struct {
+	// mu guards Clients, Started and the Range, Rate and OverRate of every
+	// client, handlers change them while the clients are being served
+	mu sync.Mutex
 	Clients map[*Client]struct{}
-	RangeChan chan int
+	// ranges are queued per engagement, workers only get their own
+	Ranges map[string][]Range
+	rangeMu sync.Mutex
 	Db *DB
+	Scope *Scope
+	Creds *CredStore
+	Governor *Governor
 	Started bool
 }
 
+// Response is what a client answered, along with what it was scanning at
+// the time.
 type Response struct {
 	Client *Client
 	Response string
+	Range *Range
+	Rate float64
 }
 
-func NewClient(ws *websocket.Conn) *Client {
+func NewClient(ws *websocket.Conn, worker *Worker) *Client {
 	return &Client{
 		Ws: ws,
 		StatusChan: make(chan string),
 		StartChan: make(chan string),
 		StopChan: make(chan string),
-		Ip: getIP(ws.Request()),
+		// the server terminates TLS itself, so no proxy headers are trusted
+		Ip: ws.Request().RemoteAddr,
+		Worker: worker,
 	}
 }
 
-func NewWSServ(db *DB) *WSServ {
+func NewWSServ(db *DB, scope *Scope, creds *CredStore) *WSServ {
 	return &WSServ{
 		Clients: make(map[*Client]struct{}),
 		Db: db,
+		Scope: scope,
+		Creds: creds,
+		Governor: NewGovernor(),
 		Started: false,
 	}
 }
 
 func (c *Client) ReadMSG() ([]string, error) {
-	buf := make([]byte, 1024)
-	n, err := c.Ws.Read(buf)
-	if err != nil {
-		return nil, err
-	}
 	var res []string
-	err = json.Unmarshal(buf[:n], &res)
+	err := websocket.JSON.Receive(c.Ws, &res)
 	return res, err
 }
 
@@ -94,20 +113,36 @@ func sendStop(c *Client) (string, error) {
 	return c.Send("stop", c.StopChan)
 }
 
-func (s *WSServ) Send(fn func(c *Client) (string, error)) ([]Response) {
-	res := make([]Response, 0, len(s.Clients))
+// clients returns the connected clients, to be used without holding mu.
+func (s *WSServ) clients() []*Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]*Client, 0, len(s.Clients))
 	for c := range s.Clients {
-		s, err := fn(c)
+		res = append(res, c)
+	}
+	return res
+}
+
+func (s *WSServ) Send(fn func(c *Client) (string, error)) ([]Response) {
+	clients := s.clients()
+	res := make([]Response, 0, len(clients))
+	for _, c := range clients {
+		str, err := fn(c)
 		if err != nil {
-			s = err.Error()
+			str = err.Error()
 		}
+		s.mu.Lock()
 		res = append(res, Response{
 			Client: c,
-			Response: s,
+			Response: str,
+			Range: c.Range,
+			Rate: c.Rate,
 		})
+		s.mu.Unlock()
 	}
 	sort.Slice(res, func(i, j int) bool {
-		return res[i].Client.Ip < res[j].Client.Ip
+		return res[i].Client.Worker.Name < res[j].Client.Worker.Name
 	})
 	return res
 }
@@ -117,46 +152,206 @@ func (s *WSServ) SendStatus() ([]Response) {
 }
 
 func (s *WSServ) SendStart() ([]Response) {
+	s.mu.Lock()
 	s.Started = true
+	s.mu.Unlock()
 	s.InitRanges()
 	return s.Send(sendStart)
 }
 
+// SendExclude pushes the opt out registry to every client.
+func (s *WSServ) SendExclude() {
+	for _, c := range s.clients() {
+		sendExclude(c, s.Scope.OptOuts)
+	}
+}
+
+func sendExclude(c *Client, o *OptOuts) error {
+	return c.WriteMSG(append([]string{"exclude"}, o.CIDRs()...)...)
+}
+
 func (s *WSServ) SendStop() ([]Response) {
+	s.mu.Lock()
 	s.Started = false
-	return s.Send(sendStop)
+	s.mu.Unlock()
+	res := s.Send(sendStop)
+	for _, c := range s.clients() {
+		s.release(c, false, "stopped")
+	}
+	return res
 }
 
-func (s *WSServ) InitRanges() {
-	arr := make([]int, 256)
-	for i := range arr {
-		arr[i] = i
+// release gives back the slot of the range c was scanning, and the range
+// itself if c didn't get through it so another worker picks it up. How the
+// range ended is audited as result. Only the first of concurrent calls for
+// the same range releases it.
+func (s *WSServ) release(c *Client, requeue bool, result string) {
+	s.mu.Lock()
+	r := c.Range
+	c.Range = nil
+	s.mu.Unlock()
+	if r == nil {
+		return
+	}
+	if requeue {
+		s.returnRange(*r)
+	}
+	s.Db.Audit(AuditEntry{
+		Engagement: r.Engagement,
+		Actor: c.Worker.Name,
+		Action: "range",
+		Target: r.CIDR,
+		Result: result,
+	})
+	s.Governor.Release(r.Engagement)
+}
+
+// Revoke drops the connections of a revoked worker straight away.
+func (s *WSServ) Revoke(name string) {
+	for _, c := range s.clients() {
+		if c.Worker.Name == name {
+			c.Ws.Close()
+		}
 	}
+}
+
+func (s *WSServ) InitRanges() {
+	arr := s.Scope.Ranges()
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(arr), func(i, j int) { arr[i], arr[j] = arr[j], arr[i] })
-	s.RangeChan = make(chan int, len(arr))
+	s.rangeMu.Lock()
+	defer s.rangeMu.Unlock()
+	s.Ranges = make(map[string][]Range)
 	for _, e := range arr {
-		s.RangeChan <- e
+		s.Ranges[e.Engagement] = append(s.Ranges[e.Engagement], e)
 	}
-	close(s.RangeChan)
 }
 
-func (s *WSServ) SendRange(c *Client) error {
-	select {
-	case x, ok := <-s.RangeChan:
-		if ok {
-			return c.WriteMSG("range", fmt.Sprintf("%d.0.0.0/8", x))
+func (s *WSServ) nextRange(engagement string) (Range, bool) {
+	s.rangeMu.Lock()
+	defer s.rangeMu.Unlock()
+	queue := s.Ranges[engagement]
+	if len(queue) == 0 {
+		return Range{}, false
+	}
+	s.Ranges[engagement] = queue[1:]
+	return queue[0], true
+}
+
+// returnRange puts r first in line again.
+func (s *WSServ) returnRange(r Range) {
+	s.rangeMu.Lock()
+	defer s.rangeMu.Unlock()
+	if s.Ranges == nil {
+		s.Ranges = make(map[string][]Range)
+	}
+	s.Ranges[r.Engagement] = append([]Range{r}, s.Ranges[r.Engagement]...)
+}
+
+func (s *WSServ) rangesLeft() int {
+	s.rangeMu.Lock()
+	defer s.rangeMu.Unlock()
+	n := 0
+	for _, queue := range s.Ranges {
+		n += len(queue)
+	}
+	return n
+}
+
+// SendRange hands out the next range along with the limits to scan it with,
+// ["range", cidr, rate, until], rate being the range's share of the
+// engagement's ceiling. until is empty when there is no window to
+// stop at. If the engagement is outside its windows or at its maximum
+// targets the worker is told to ask again later, ["range", "wait", seconds].
+// cut is set when the worker had to stop its last range before the end.
+func (s *WSServ) SendRange(c *Client, cut bool) error {
+	if cut {
+		s.release(c, true, "cut off by the maintenance window, returned")
+	} else {
+		s.release(c, false, "finished")
+	}
+	engagement := c.Worker.Engagement
+	limits, until, wait := s.Governor.Acquire(engagement, time.Now())
+	if wait > 0 {
+		return c.WriteMSG("range", "wait", strconv.Itoa(int(wait.Seconds()) + 1))
+	}
+	if x, ok := s.nextRange(engagement); ok {
+		s.mu.Lock()
+		c.Range = &x
+		c.OverRate = false
+		s.mu.Unlock()
+		untilStr := ""
+		if !until.IsZero() {
+			untilStr = until.Format(time.RFC3339)
 		}
+		s.Db.Audit(AuditEntry{
+			Engagement: x.Engagement,
+			Actor: c.Worker.Name,
+			Action: "range",
+			Target: x.CIDR,
+			Result: fmt.Sprintf("assigned at %d pps", limits.TargetRate()),
+		})
+		return c.WriteMSG("range", x.CIDR, strconv.Itoa(limits.TargetRate()), untilStr)
+	}
+	s.Governor.Release(engagement)
+	// other engagements may still have work for workers that connect later
+	if s.rangesLeft() == 0 {
+		s.mu.Lock()
 		s.Started = false
-		return c.WriteMSG("range", "stop")
-	default:
-		s.Started = false
-		return c.WriteMSG("range", "stop")
+		s.mu.Unlock()
+	}
+	return c.WriteMSG("range", "stop")
+}
+
+// SetRate records the rate a worker reports, going over the ceiling is
+// audited once each time it happens since the worker should have kept to it.
+func (s *WSServ) SetRate(c *Client, rate string) {
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	c.Rate = r
+	rnge := c.Range
+	if rnge == nil {
+		s.mu.Unlock()
+		return
+	}
+	ceiling := limitsFor(rnge.Engagement).TargetRate()
+	over := r > float64(ceiling) * 1.1
+	crossed := over && !c.OverRate
+	c.OverRate = over
+	s.mu.Unlock()
+	if crossed {
+		log.Printf("%s scanning %s at %.0f pps, ceiling is %d", c.Worker.Name, rnge.CIDR, r, ceiling)
+		s.Db.Audit(AuditEntry{
+			Engagement: rnge.Engagement,
+			Actor: c.Worker.Name,
+			Action: "rate exceeded",
+			Target: rnge.CIDR,
+			Result: fmt.Sprintf("%.0f pps, ceiling %d", r, ceiling),
+		})
 	}
 }
 
 func (s *WSServ) SendVNC(ip, port string, c *Client) error {
-	err := AddVNC(ip, port, "", "", s.Db)
+	entry, err := s.Scope.Check(ip)
+	if err == nil && entry.Engagement != c.Worker.Engagement {
+		err = errOutOfScope
+	}
+	if err != nil {
+		log.Printf("Rejected %s:%s from %s: %s", ip, port, c.Worker.Name, err.Error())
+		s.Db.Audit(AuditEntry{
+			Engagement: s.Scope.EngagementOf(ip),
+			Actor: c.Worker.Name,
+			Action: "vnc",
+			Target: net.JoinHostPort(ip, port),
+			Result: err.Error(),
+		})
+		c.WriteMSG("vnc", err.Error())
+		return err
+	}
+	err = AddVNC(ip, port, c.Worker.Name, s.Db, s.Scope, s.Creds)
 	if err != nil {
 		c.WriteMSG("vnc", err.Error())
 	} else {
@@ -165,24 +360,32 @@ func (s *WSServ) SendVNC(ip, port string, c *Client) error {
 	return err
 }
 
-func (s *WSServ) ServeWS(ws *websocket.Conn) {
-	client := NewClient(ws)
-	log.Println("Conn", client.Ip)
+func (s *WSServ) ServeWS(ws *websocket.Conn, worker *Worker) {
+	client := NewClient(ws, worker)
+	log.Println("Conn", worker.Name, client.Ip)
+	s.mu.Lock()
 	s.Clients[client] = struct{}{}
+	started := s.Started
+	s.mu.Unlock()
 	ticker := time.NewTicker(CFGClientPing)
 	done := make(chan struct{})
 	defer func() {
-		log.Println("Disc", client.Ip)
+		log.Println("Disc", worker.Name, client.Ip)
 		ticker.Stop()
 		done <- struct{}{}
 		client.Ws.Close()
 		close(client.StatusChan)
 		close(client.StartChan)
 		close(client.StopChan)
+		s.mu.Lock()
 		delete(s.Clients, client)
+		s.mu.Unlock()
+		s.release(client, true, "returned unfinished")
 	}()
 
-	if s.Started {
+	sendExclude(client, s.Scope.OptOuts)
+
+	if started {
 		go sendStart(client)
 	}
 
@@ -190,7 +393,14 @@ func (s *WSServ) ServeWS(ws *websocket.Conn) {
 		for {
 			select {
 			case <-done: return
-			case <-ticker.C: client.WriteMSG("ping")
+			case <-ticker.C:
+				// catches revocations made from the command line too
+				if w, err := s.Db.GetWorker(worker.Name); err != nil || w.Revoked ||
+					w.Fingerprint != worker.Fingerprint {
+					client.Ws.Close()
+					return
+				}
+				client.WriteMSG("ping")
 			}
 		}
 	}()
@@ -204,22 +414,15 @@ func (s *WSServ) ServeWS(ws *websocket.Conn) {
 		if len(msg) < 1 {
 			continue
 		}
-		log.Printf("Got %s from %s", msg, client.Ip)
+		log.Printf("Got %s from %s", msg, worker.Name)
 
 		switch msg[0] {
 		case "status": client.StatusChan <- msg[1]
 		case "start": client.StartChan <- msg[1]
 		case "stop": client.StopChan <- msg[1]
-		case "range": s.SendRange(client)
+		case "range": s.SendRange(client, len(msg) > 1 && msg[1] == "cut")
+		case "rate": s.SetRate(client, msg[1])
 		case "vnc": go s.SendVNC(msg[1], msg[2], client)
 		}
 	}
 }
-
-func getIP(r *http.Request) string {
-	ip := r.Header.Get("X-REAL-IP")
-	if ip != "" {
-		return ip
-	}
-	return r.RemoteAddr
-}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// TestSendExcludeLarge sends an exclude list well over the size of a single
+// read, it has to arrive whole.
+func TestSendExcludeLarge(t *testing.T) {
+	o := &OptOuts{}
+	for i := 0; i < 500; i++ {
+		_, n, _ := net.ParseCIDR(fmt.Sprintf("10.%d.%d.0/24", i / 256, i % 256))
+		o.nets = append(o.nets, n)
+	}
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		sendExclude(&Client{Ws: ws}, o)
+		ws.Read(make([]byte, 1))
+	}))
+	defer srv.Close()
+
+	ws, err := websocket.Dial("ws" + strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	msg, err := (&Client{Ws: ws}).ReadMSG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg) != 501 || msg[0] != "exclude" || msg[500] != "10.1.243.0/24" {
+		t.Errorf("got %d fields ending in %s", len(msg), msg[len(msg) - 1])
+	}
+}
@@ -1,5 +1,7 @@
 #include <rfb/rfbclient.h>
 #include <jpeglib.h>
+#include <stdio.h>
+#include <string.h>
 
 typedef struct
 {
@@ -199,10 +201,23 @@ err:
     return "Some error";
 }
 
+// reads one line of stdin without its newline, credentials come this way
+// so they never show up in the process list
+char *readline(char *buf, int size)
+{
+    if (!fgets(buf, size, stdin))
+        buf[0] = 0;
+    buf[strcspn(buf, "\n")] = 0;
+    return buf;
+}
+
 int main(int argc, char *argv[])
 {
     VNCInfo ret;
-    char *res = screenshot(atoi(argv[1]), argv[2], atoi(argv[3]), argv[4], argv[5], argv[6], &ret);
+    char username[256], password[256];
+    readline(username, sizeof(username));
+    readline(password, sizeof(password));
+    char *res = screenshot(atoi(argv[1]), argv[2], atoi(argv[3]), argv[4], username, password, &ret);
     if (res)
     {
         puts(res);